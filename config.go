@@ -4,8 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
+	"gitlab.com/aki237/pin/pinlib"
 	"gopkg.in/yaml.v2"
 )
 
@@ -47,18 +51,491 @@ const (
 	CLIENT
 )
 
+// UserConfig struct holds the credentials of a single user allowed to connect to the server
+type UserConfig struct {
+	Name      string           `yaml:"name"`
+	Secret    string           `yaml:"secret"`
+	Group     string           `yaml:"group"`
+	Subnets   []string         `yaml:"subnets"`
+	RateLimit *RateLimitConfig `yaml:"rateLimit"`
+}
+
+// PeerConfig struct holds the static public key of a single client allowed to connect to the server
+type PeerConfig struct {
+	Name      string           `yaml:"name"`
+	PublicKey string           `yaml:"publicKey"`
+	Group     string           `yaml:"group"`
+	Subnets   []string         `yaml:"subnets"`
+	RateLimit *RateLimitConfig `yaml:"rateLimit"`
+}
+
+// RateLimitConfig struct holds the bandwidth allowed to a client, the rates in bytes per second
+type RateLimitConfig struct {
+	In       uint64        `yaml:"in"`
+	Out      uint64        `yaml:"out"`
+	Burst    uint64        `yaml:"burst"`
+	MaxDelay time.Duration `yaml:"maxDelay"`
+}
+
+// limit method returns the rate limit of the config.
+func (rc *RateLimitConfig) limit() pinlib.RateLimit {
+	return pinlib.RateLimit{In: rc.In, Out: rc.Out, Burst: rc.Burst, MaxDelay: rc.MaxDelay}
+}
+
+// PushSettings struct holds the settings a server pushes to its clients
+type PushSettings struct {
+	DNS    []string `yaml:"dns"`
+	Routes []string `yaml:"routes"`
+	MTU    int      `yaml:"mtu"`
+}
+
+// ACLRuleConfig struct holds a single rule of an ACL. The ports are either a single port or "from-to".
+type ACLRuleConfig struct {
+	Action   string `yaml:"action"`
+	Network  string `yaml:"network"`
+	Protocol string `yaml:"protocol"`
+	Ports    string `yaml:"ports"`
+}
+
+// ACLConfig struct holds the packet filter of some users and groups
+type ACLConfig struct {
+	Users   []string        `yaml:"users"`
+	Groups  []string        `yaml:"groups"`
+	Default string          `yaml:"default"`
+	Rules   []ACLRuleConfig `yaml:"rules"`
+}
+
 // Config struct is used to store the values parsed from the config file
 type Config struct {
 	Mode                 RunMode           `yaml:"mode"`
 	Address              string            `yaml:"address"`
+	Endpoints            []string          `yaml:"endpoints"`
+	EndpointOrder        string            `yaml:"endpointOrder"`
+	Transport            string            `yaml:"transport"`
 	MTU                  int               `yaml:"mtu"`
 	InterfaceName        string            `yaml:"interfaceName"`
 	DHCP                 string            `yaml:"dhcp"`
+	DHCP6                string            `yaml:"dhcp6"`
 	DNS                  []string          `yaml:"dns"`
 	Secret               string            `yaml:"secret"`
+	User                 string            `yaml:"user"`
+	Users                []UserConfig      `yaml:"users"`
+	PrivateKey           string            `yaml:"privateKey"`
+	Peers                []PeerConfig      `yaml:"peers"`
+	Push                 PushSettings      `yaml:"push"`
 	PostInitScript       map[string]string `yaml:"postServerInit"`
 	PostConnectScript    map[string]string `yaml:"postConnect"`
 	PostDisconnectScript map[string]string `yaml:"postDisconnect"`
+	RekeyInterval        time.Duration     `yaml:"rekeyInterval"`
+	RekeyBytes           uint64            `yaml:"rekeyBytes"`
+	RekeyGrace           time.Duration     `yaml:"rekeyGrace"`
+	ResumeWindow         time.Duration     `yaml:"resumeWindow"`
+	ReconnectAttempts    int               `yaml:"reconnectAttempts"`
+	ReconnectDelay       time.Duration     `yaml:"reconnectDelay"`
+	ReconnectMaxDelay    time.Duration     `yaml:"reconnectMaxDelay"`
+	KeepaliveInterval    time.Duration     `yaml:"keepaliveInterval"`
+	KeepaliveTimeout     time.Duration     `yaml:"keepaliveTimeout"`
+	HandshakeTimeout     time.Duration     `yaml:"handshakeTimeout"`
+	MaxPendingHandshakes int               `yaml:"maxPendingHandshakes"`
+	ExcludeLeases        []string          `yaml:"excludeLeases"`
+	StaticLeases         map[string]string `yaml:"staticLeases"`
+	LeaseFile            string            `yaml:"leaseFile"`
+	LeaseDuration        time.Duration     `yaml:"leaseDuration"`
+	PreferredIP          string            `yaml:"preferredIP"`
+	LastLeaseFile        string            `yaml:"lastLeaseFile"`
+	ClientRouting        string            `yaml:"clientRouting"`
+	Advertise            []string          `yaml:"advertise"`
+	ACLs                 []ACLConfig       `yaml:"acls"`
+	RateLimit            RateLimitConfig   `yaml:"rateLimit"`
+}
+
+// RekeyPolicy returns the key rotation policy for the session.
+// Values not specified in the config file are taken from pinlib.DefaultRekeyPolicy.
+func (c *Config) RekeyPolicy() (pinlib.RekeyPolicy, error) {
+	policy := pinlib.DefaultRekeyPolicy
+	if c.RekeyInterval > 0 {
+		policy.Interval = c.RekeyInterval
+	}
+	if c.RekeyBytes > 0 {
+		policy.Bytes = c.RekeyBytes
+	}
+	if c.RekeyGrace > 0 {
+		policy.Grace = c.RekeyGrace
+	}
+	if policy.Interval < pinlib.MinRekeyInterval {
+		return policy, fmt.Errorf("Config parse error : rekeyInterval %s is shorter than %s", policy.Interval, pinlib.MinRekeyInterval)
+	}
+	if policy.Bytes < pinlib.MinRekeyBytes {
+		return policy, fmt.Errorf("Config parse error : rekeyBytes %d is less than %d", policy.Bytes, pinlib.MinRekeyBytes)
+	}
+	return policy, nil
+}
+
+// RemoteEndpoints returns the endpoints of the servers a client fails over between.
+// Without a list of endpoints, this is just the address.
+func (c *Config) RemoteEndpoints() []string {
+	if len(c.Endpoints) == 0 {
+		return []string{c.Address}
+	}
+	return c.Endpoints
+}
+
+// Backoff returns the delays between the attempts of the client to reconnect.
+// Values not specified in the config file are taken from pinlib.DefaultBackoff.
+func (c *Config) Backoff() pinlib.Backoff {
+	backoff := pinlib.DefaultBackoff
+	if c.ReconnectDelay > 0 {
+		backoff.Initial = c.ReconnectDelay
+	}
+	if c.ReconnectMaxDelay > 0 {
+		backoff.Max = c.ReconnectMaxDelay
+	}
+	return backoff
+}
+
+// Keepalive returns how the session notices a dead peer.
+// Values not specified in the config file are taken from pinlib.DefaultKeepalive.
+func (c *Config) Keepalive() (pinlib.Keepalive, error) {
+	keepalive := pinlib.DefaultKeepalive
+	if c.KeepaliveInterval > 0 {
+		keepalive.Interval = c.KeepaliveInterval
+	}
+	if c.KeepaliveTimeout > 0 {
+		keepalive.Timeout = c.KeepaliveTimeout
+	}
+	if keepalive.Timeout <= keepalive.Interval {
+		return keepalive, fmt.Errorf("Config parse error : keepaliveTimeout %s has to be longer than keepaliveInterval %s", keepalive.Timeout, keepalive.Interval)
+	}
+	return keepalive, nil
+}
+
+// UserSecrets returns the decoded secret of every configured user keyed by the user name.
+func (c *Config) UserSecrets() (map[string][32]byte, error) {
+	users := make(map[string][32]byte, len(c.Users))
+	for _, user := range c.Users {
+		if user.Name == "" {
+			return nil, errors.New("Config parse error : user without a name")
+		}
+		if _, ok := users[user.Name]; ok {
+			return nil, fmt.Errorf("Config parse error : duplicate user '%s'", user.Name)
+		}
+		secret, err := decodeSecret(user.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("Config parse error : user '%s': %s", user.Name, err)
+		}
+		users[user.Name] = secret
+	}
+	return users, nil
+}
+
+// PeerKeys returns the name of every configured peer keyed by its decoded public key.
+func (c *Config) PeerKeys() (map[[32]byte]string, error) {
+	peers := make(map[[32]byte]string, len(c.Peers))
+	for _, peer := range c.Peers {
+		if peer.Name == "" {
+			return nil, errors.New("Config parse error : peer without a name")
+		}
+		pub, err := decodeSecret(peer.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("Config parse error : peer '%s': %s", peer.Name, err)
+		}
+		if _, ok := peers[pub]; ok {
+			return nil, fmt.Errorf("Config parse error : duplicate public key for peer '%s'", peer.Name)
+		}
+		peers[pub] = peer.Name
+	}
+	return peers, nil
+}
+
+// UserGroups returns the group of every configured user and peer which has one.
+func (c *Config) UserGroups() map[string]string {
+	groups := make(map[string]string)
+	for _, user := range c.Users {
+		if user.Group != "" {
+			groups[user.Name] = user.Group
+		}
+	}
+	for _, peer := range c.Peers {
+		if peer.Group != "" {
+			groups[peer.Name] = peer.Group
+		}
+	}
+	return groups
+}
+
+// UserSubnets returns the networks every configured user and peer may advertise subnets within.
+func (c *Config) UserSubnets() (map[string][]*net.IPNet, error) {
+	subnets := make(map[string][]*net.IPNet)
+	add := func(name string, nets []string) error {
+		parsed, err := parseNets(nets)
+		if err != nil {
+			return fmt.Errorf("Config parse error : subnets of '%s': %s", name, err)
+		}
+		subnets[name] = append(subnets[name], parsed...)
+		return nil
+	}
+
+	for _, user := range c.Users {
+		if err := add(user.Name, user.Subnets); err != nil {
+			return nil, err
+		}
+	}
+	for _, peer := range c.Peers {
+		if err := add(peer.Name, peer.Subnets); err != nil {
+			return nil, err
+		}
+	}
+	return subnets, nil
+}
+
+// AdvertisedSubnets returns the subnets behind the client, advertised to the server.
+func (c *Config) AdvertisedSubnets() ([]*net.IPNet, error) {
+	subnets, err := parseNets(c.Advertise)
+	if err != nil {
+		return nil, fmt.Errorf("Config parse error : advertise: %s", err)
+	}
+	return subnets, nil
+}
+
+// parseNets parses a list of networks in the CIDR notation.
+func parseNets(nets []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, n := range nets {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet '%s'", n)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// PacketFilters returns the ACL of every user and of every group an ACL is configured for.
+func (c *Config) PacketFilters() (map[string]*pinlib.ACL, map[string]*pinlib.ACL, error) {
+	users := make(map[string]*pinlib.ACL)
+	groups := make(map[string]*pinlib.ACL)
+	for i, ac := range c.ACLs {
+		acl, err := ac.parse()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Config parse error : acl %d: %s", i+1, err)
+		}
+		for _, user := range ac.Users {
+			if _, ok := users[user]; ok {
+				return nil, nil, fmt.Errorf("Config parse error : more than one acl for user '%s'", user)
+			}
+			users[user] = acl
+		}
+		for _, group := range ac.Groups {
+			if _, ok := groups[group]; ok {
+				return nil, nil, fmt.Errorf("Config parse error : more than one acl for group '%s'", group)
+			}
+			groups[group] = acl
+		}
+	}
+	return users, groups, nil
+}
+
+// parse method returns the ACL of the config.
+func (ac *ACLConfig) parse() (*pinlib.ACL, error) {
+	acl := &pinlib.ACL{}
+	var err error
+	acl.Default, err = parseACLAction(ac.Default, pinlib.ACLDeny)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rc := range ac.Rules {
+		rule := pinlib.ACLRule{}
+		rule.Action, err = parseACLAction(rc.Action, pinlib.ACLAllow)
+		if err != nil {
+			return nil, err
+		}
+		if rc.Network != "" {
+			_, rule.Network, err = net.ParseCIDR(rc.Network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network '%s'", rc.Network)
+			}
+		}
+		rule.Protocol, err = parseProtocol(rc.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		if rc.Ports != "" {
+			rule.FromPort, rule.ToPort, err = parsePorts(rc.Ports)
+			if err != nil {
+				return nil, err
+			}
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	return acl, nil
+}
+
+// parseACLAction parses an ACL action, def if not specified.
+func parseACLAction(action string, def pinlib.ACLAction) (pinlib.ACLAction, error) {
+	switch strings.ToLower(action) {
+	case "":
+		return def, nil
+	case "allow":
+		return pinlib.ACLAllow, nil
+	case "deny":
+		return pinlib.ACLDeny, nil
+	}
+	return def, fmt.Errorf("invalid action '%s': expects either 'allow' or 'deny'", action)
+}
+
+// parseProtocol parses an IP protocol, either by its name or number. 0 stands for any.
+func parseProtocol(proto string) (byte, error) {
+	switch strings.ToLower(proto) {
+	case "", "any":
+		return 0, nil
+	case "icmp":
+		return 1, nil
+	case "tcp":
+		return 6, nil
+	case "udp":
+		return 17, nil
+	case "icmpv6":
+		return 58, nil
+	case "sctp":
+		return 132, nil
+	}
+	n, err := strconv.ParseUint(proto, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol '%s'", proto)
+	}
+	return byte(n), nil
+}
+
+// parsePorts parses a single port or an inclusive range of ports "from-to".
+func parsePorts(ports string) (uint16, uint16, error) {
+	bounds := strings.SplitN(ports, "-", 2)
+	from, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+	if err != nil || from == 0 {
+		return 0, 0, fmt.Errorf("invalid ports '%s'", ports)
+	}
+	to := from
+	if len(bounds) == 2 {
+		to, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+		if err != nil || to < from {
+			return 0, 0, fmt.Errorf("invalid ports '%s'", ports)
+		}
+	}
+	return uint16(from), uint16(to), nil
+}
+
+// RateLimits returns the rate limit of every client, and of every configured user and peer
+// which has one of its own.
+func (c *Config) RateLimits() (pinlib.RateLimit, map[string]pinlib.RateLimit) {
+	limits := make(map[string]pinlib.RateLimit)
+	for _, user := range c.Users {
+		if user.RateLimit != nil {
+			limits[user.Name] = user.RateLimit.limit()
+		}
+	}
+	for _, peer := range c.Peers {
+		if peer.RateLimit != nil {
+			limits[peer.Name] = peer.RateLimit.limit()
+		}
+	}
+	return c.RateLimit.limit(), limits
+}
+
+// ClientRoutingPolicy returns the policy for the packets between the clients.
+// If not specified in the config file, they are left to the kernel.
+func (c *Config) ClientRoutingPolicy() (pinlib.ClientRouting, error) {
+	switch strings.ToLower(c.ClientRouting) {
+	case "", "kernel":
+		return pinlib.ClientRoutingKernel, nil
+	case "allow":
+		return pinlib.ClientRoutingAllow, nil
+	case "deny":
+		return pinlib.ClientRoutingDeny, nil
+	case "group":
+		return pinlib.ClientRoutingGroup, nil
+	}
+	return pinlib.ClientRoutingKernel, fmt.Errorf("Config parse error : invalid clientRouting '%s': expects one of 'kernel', 'allow', 'deny' or 'group'", c.ClientRouting)
+}
+
+// PushConfig returns the parsed settings the server pushes to its clients.
+func (c *Config) PushConfig() (pinlib.PushConfig, error) {
+	push := pinlib.PushConfig{MTU: c.Push.MTU}
+	for _, dns := range c.Push.DNS {
+		ip := net.ParseIP(dns)
+		if ip == nil {
+			return push, fmt.Errorf("Config parse error : invalid pushed DNS server '%s'", dns)
+		}
+		push.DNS = append(push.DNS, ip)
+	}
+	for _, route := range c.Push.Routes {
+		_, ipNet, err := net.ParseCIDR(route)
+		if err != nil {
+			return push, fmt.Errorf("Config parse error : invalid pushed route '%s'", route)
+		}
+		push.Routes = append(push.Routes, ipNet)
+	}
+	if push.MTU < 0 || push.MTU > c.MTU {
+		return push, fmt.Errorf("Config parse error : pushed MTU %d out of range", push.MTU)
+	}
+	return push, nil
+}
+
+// SetupLeases excludes the configured addresses from the lease pool and reserves the static
+// addresses of the users. An excluded range is either a single address or "from-to".
+// The leases are then restored from the lease file, if any.
+func (c *Config) SetupLeases(pool *pinlib.LeasePool) error {
+	if c.LeaseDuration > 0 {
+		pool.Duration = c.LeaseDuration
+	}
+	for _, r := range c.ExcludeLeases {
+		bounds := strings.SplitN(r, "-", 2)
+		from := net.ParseIP(strings.TrimSpace(bounds[0]))
+		to := from
+		if len(bounds) == 2 {
+			to = net.ParseIP(strings.TrimSpace(bounds[1]))
+		}
+		if from == nil || to == nil {
+			return fmt.Errorf("Config parse error : invalid excluded lease range '%s'", r)
+		}
+		if err := pool.Exclude(from, to); err != nil {
+			return fmt.Errorf("Config parse error : excluded lease range '%s': %s", r, err)
+		}
+	}
+	for user, addr := range c.StaticLeases {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("Config parse error : invalid static lease '%s' for '%s'", addr, user)
+		}
+		if err := pool.Reserve(user, ip); err != nil {
+			return fmt.Errorf("Config parse error : static lease for '%s': %s", user, err)
+		}
+	}
+	if c.LeaseFile != "" {
+		return pool.Open(c.LeaseFile)
+	}
+	return nil
+}
+
+// PreferredAddress returns the address the client asks to be leased. Without a preferredIP,
+// this is the address last leased, as saved to the lastLeaseFile, nil if there is none.
+func (c *Config) PreferredAddress() (net.IP, error) {
+	if c.PreferredIP != "" {
+		ip := net.ParseIP(c.PreferredIP)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("Config parse error : invalid preferredIP '%s'", c.PreferredIP)
+		}
+		return ip, nil
+	}
+	if c.LastLeaseFile == "" {
+		return nil, nil
+	}
+
+	contents, err := ioutil.ReadFile(c.LastLeaseFile)
+	if err != nil {
+		// nothing leased yet
+		return nil, nil
+	}
+	return net.ParseIP(strings.TrimSpace(string(contents))).To4(), nil
 }
 
 // NewConfigFromFile is used to read configuration data from provided filename and return a Config struct
@@ -77,11 +554,52 @@ func NewConfigFromFile(filename string) (*Config, error) {
 	}
 
 	if config.Address == "" {
-		return nil, fmt.Errorf("Config parse error : no address specified")
+		if config.Mode == SERVER || len(config.Endpoints) == 0 {
+			return nil, fmt.Errorf("Config parse error : no address specified")
+		}
+		config.Address = config.Endpoints[0]
+	}
+
+	switch strings.ToLower(config.EndpointOrder) {
+	case "", "ordered":
+		config.EndpointOrder = "ordered"
+	case "random":
+		config.EndpointOrder = "random"
+	default:
+		return nil, fmt.Errorf("Config parse error : invalid endpointOrder '%s': expects either 'ordered' or 'random'", config.EndpointOrder)
+	}
+
+	if config.HandshakeTimeout < 0 || config.MaxPendingHandshakes < 0 {
+		return nil, fmt.Errorf("Config parse error : handshakeTimeout and maxPendingHandshakes can't be negative")
+	}
+
+	if config.RateLimit.MaxDelay < 0 {
+		return nil, fmt.Errorf("Config parse error : rateLimit maxDelay can't be negative")
+	}
+
+	if config.LeaseDuration < 0 {
+		return nil, fmt.Errorf("Config parse error : leaseDuration can't be negative")
+	}
+
+	if config.ReconnectAttempts < 0 {
+		return nil, fmt.Errorf("Config parse error : reconnectAttempts can't be negative")
+	}
+
+	switch strings.ToLower(config.Transport) {
+	case "", pinlib.TransportTCP:
+		config.Transport = pinlib.TransportTCP
+	case pinlib.TransportUDP:
+		config.Transport = pinlib.TransportUDP
+	default:
+		return nil, fmt.Errorf("Config parse error : invalid transport '%s': expects either 'tcp' or 'udp'", config.Transport)
 	}
 
+	// over udp, a full packet has to fit a datagram through a path of the usual 1500 MTU
+	mtu := pinlib.TunnelMTU(config.Transport, 1500)
 	if config.MTU <= 0 {
-		config.MTU = 1500
+		config.MTU = mtu
+	} else if config.MTU > mtu {
+		fmt.Printf("[WARN] mtu %d is above %d, the largest packets will be fragmented over %s\n", config.MTU, mtu, config.Transport)
 	}
 
 	return config, nil
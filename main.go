@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"os"
@@ -21,6 +22,7 @@ func printVersionInfo() {
 
 func main() {
 	versionPrint := flag.Bool("v", false, "print the version info")
+	genKey := flag.Bool("genkey", false, "generate a client key pair for public key authentication")
 
 	flag.Usage = func() {
 		printVersionInfo()
@@ -37,6 +39,17 @@ func main() {
 		return
 	}
 
+	if *genKey {
+		priv, pub, err := pinlib.GenerateKey()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("privateKey : " + base64.StdEncoding.EncodeToString(priv[:]))
+		fmt.Println("publicKey : " + base64.StdEncoding.EncodeToString(pub[:]))
+		return
+	}
+
 	if len(flag.Args()) != 1 {
 		flag.Usage()
 		return
@@ -51,7 +64,7 @@ func main() {
 	}
 
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGTSTP)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGTSTP, syscall.SIGUSR1)
 
 	pinlib.MTU = config.MTU
 	switch config.Mode {
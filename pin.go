@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sort"
 	"syscall"
 
 	"gitlab.com/aki237/pin/pinlib"
@@ -19,13 +20,19 @@ func RunPin(config *Config, c chan os.Signal) {
 	}
 
 	go func() {
-		recdsig := <-c
-		switch recdsig {
-		case syscall.SIGTSTP:
+		for {
+			recdsig := <-c
+			switch recdsig {
+			case syscall.SIGTSTP:
+				return
+			case syscall.SIGUSR1:
+				printStats(session)
+				continue
+			}
+			session.peer.Close()
+			fmt.Print("\r Closing stuff")
 			return
 		}
-		session.peer.Close()
-		fmt.Print("\r Closing stuff")
 	}()
 
 	if session.Mode != SERVER {
@@ -38,6 +45,42 @@ func RunPin(config *Config, c chan os.Signal) {
 	}
 }
 
+// printStats prints the counters of the session, the packets filtered so far and so on.
+func printStats(session *Session) {
+	if client, ok := session.peer.(*pinlib.Client); ok {
+		stat := client.GetTxnStat()
+		if stat == nil {
+			fmt.Println("Not connected yet")
+			return
+		}
+		fmt.Printf("Bytes transferred : %d in, %d out\n", stat.In, stat.Out)
+		fmt.Printf("Packets dropped : %d replayed, %d failing to authenticate\n", stat.Replayed, stat.Dropped)
+		return
+	}
+
+	srv, ok := session.peer.(*pinlib.Server)
+	if !ok {
+		return
+	}
+
+	filtered := srv.GetFilterStat()
+	shaped := srv.GetShapingStat()
+	fmt.Printf("Handshakes failed : %d\n", srv.GetHandshakeFailures())
+	fmt.Printf("Packets filtered : %d from the clients, %d to the clients\n", filtered.In, filtered.Out)
+	fmt.Printf("Bytes shaped : %d delayed and %d dropped from the clients, %d delayed and %d dropped to the clients\n", shaped.DelayedIn, shaped.DroppedIn, shaped.DelayedOut, shaped.DroppedOut)
+	fmt.Printf("Bytes dropped from full client queues : %d\n", srv.GetQueueDrops())
+
+	replays := srv.GetReplayStats()
+	clients := make([]string, 0, len(replays))
+	for ip := range replays {
+		clients = append(clients, ip)
+	}
+	sort.Strings(clients)
+	for _, ip := range clients {
+		fmt.Printf("Packets dropped from %s : %d replayed, %d failing to authenticate\n", ip, replays[ip].Replayed, replays[ip].Dropped)
+	}
+}
+
 func GetSessionForConfig(config *Config) (*Session, error) {
 	server := config.Mode == SERVER
 	var err error
@@ -45,25 +88,28 @@ func GetSessionForConfig(config *Config) (*Session, error) {
 	session.Config = config
 	iface := NewTUN(&session.InterfaceName)
 
-	remoteAddress, err := net.ResolveTCPAddr("tcp", session.Address)
-	if err != nil {
-		return nil, err
-	}
+	session.Endpoint = session.Address
 
-	session.RemotePort = remoteAddress.Port
-	session.ResolvedRemoteIP = remoteAddress.IP
+	// a client failing over between endpoints has the one it connects to resolved by the hook,
+	// the first one not resolving is no reason to give up on the others
+	if server || len(session.Endpoints) == 0 {
+		remoteAddress, err := net.ResolveTCPAddr("tcp", session.Address)
+		if err != nil {
+			return nil, err
+		}
 
-	secretdec, err := base64.StdEncoding.DecodeString(session.Secret)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(secretdec) != 32 {
-		return nil, fmt.Errorf("Error : key length mismatch, need 40 got %d", len(secretdec))
+		session.RemotePort = remoteAddress.Port
+		session.ResolvedRemoteIP = remoteAddress.IP
+		session.RemoteFamily = addressFamily(remoteAddress.IP)
 	}
 
 	var kcn [32]byte
-	copy(kcn[:], secretdec)
+	if session.Secret != "" || !server || len(session.Users) == 0 || len(session.Peers) > 0 {
+		kcn, err = decodeSecret(session.Secret)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if server {
 		var ipNet *net.IPNet
@@ -73,18 +119,128 @@ func GetSessionForConfig(config *Config) (*Session, error) {
 			return nil, err
 		}
 		ipNet.IP = ip
-		session.peer, err = pinlib.NewServer(session.Address, iface, ipNet, kcn)
+		srv, err := pinlib.NewServer(session.Transport, session.Address, iface, ipNet, kcn)
+		if err != nil {
+			return nil, err
+		}
+		srv.Rekey, err = config.RekeyPolicy()
+		if err != nil {
+			return nil, err
+		}
+		srv.ResumeWindow = config.ResumeWindow
+		if config.HandshakeTimeout > 0 {
+			srv.HandshakeTimeout = config.HandshakeTimeout
+		}
+		if config.MaxPendingHandshakes > 0 {
+			srv.MaxPendingHandshakes = config.MaxPendingHandshakes
+		}
+		srv.Keepalive, err = config.Keepalive()
+		if err != nil {
+			return nil, err
+		}
+		if session.DHCP6 != "" {
+			ip6, ipNet6, err := net.ParseCIDR(session.DHCP6)
+			if err != nil {
+				return nil, err
+			}
+			if ip6.To4() != nil {
+				return nil, fmt.Errorf("Config parse error : dhcp6 '%s' is not an IPv6 network", session.DHCP6)
+			}
+			ipNet6.IP = ip6
+			srv.IPv6 = ipNet6
+		}
+		srv.Users, err = config.UserSecrets()
+		if err != nil {
+			return nil, err
+		}
+		srv.PublicKeys, err = config.PeerKeys()
+		if err != nil {
+			return nil, err
+		}
+		srv.Push, err = config.PushConfig()
 		if err != nil {
 			return nil, err
 		}
+		err = config.SetupLeases(srv.Leases)
+		if err != nil {
+			return nil, err
+		}
+		srv.ClientRouting, err = config.ClientRoutingPolicy()
+		if err != nil {
+			return nil, err
+		}
+		srv.Groups = config.UserGroups()
+		srv.Subnets, err = config.UserSubnets()
+		if err != nil {
+			return nil, err
+		}
+		srv.ACLs, srv.GroupACLs, err = config.PacketFilters()
+		if err != nil {
+			return nil, err
+		}
+		srv.RateLimit, srv.RateLimits = config.RateLimits()
+		session.peer = srv
 		err = session.SetupServer()
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		session.peer = pinlib.NewClient(session.Address, iface, kcn)
+		// the address family and IP exported to the scripts are updated by the hook
+		// to the ones of the endpoint the connection is made with.
+		client := pinlib.NewClient(session.Address, iface, kcn)
+		client.Endpoints = config.RemoteEndpoints()
+		client.RandomEndpoints = config.EndpointOrder == "random"
+		client.Transport = config.Transport
+		client.Rekey, err = config.RekeyPolicy()
+		if err != nil {
+			return nil, err
+		}
+		client.MaxAttempts = config.ReconnectAttempts
+		client.Keepalive, err = config.Keepalive()
+		if err != nil {
+			return nil, err
+		}
+		client.Backoff = config.Backoff()
+		if config.HandshakeTimeout > 0 {
+			client.HandshakeTimeout = config.HandshakeTimeout
+		}
+		client.OnState = func(state pinlib.ClientState) {
+			fmt.Println("Client state : ", state)
+		}
+		client.User = config.User
+		client.PreferredIP, err = config.PreferredAddress()
+		if err != nil {
+			return nil, err
+		}
+		client.Subnets, err = config.AdvertisedSubnets()
+		if err != nil {
+			return nil, err
+		}
+		if config.PrivateKey != "" {
+			key, err := decodeSecret(config.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			client.Key = &key
+		}
+		session.peer = client
 
 		session.SetupClient()
 	}
 	return session, nil
 }
+
+func decodeSecret(secret string) ([32]byte, error) {
+	var kcn [32]byte
+	secretdec, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return kcn, err
+	}
+
+	if len(secretdec) != 32 {
+		return kcn, fmt.Errorf("Error : key length mismatch, need 32 got %d", len(secretdec))
+	}
+
+	copy(kcn[:], secretdec)
+	return kcn, nil
+}
@@ -0,0 +1,88 @@
+package pinlib
+
+import "net"
+
+// ACLAction is what becomes of a packet matching an ACLRule.
+type ACLAction int
+
+// All the available ACLActions
+const (
+	ACLDeny  ACLAction = iota // the packet is dropped
+	ACLAllow                  // the packet is let through
+)
+
+// String method implements the stringer interface
+func (a ACLAction) String() string {
+	if a == ACLAllow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// ACLRule matches the packets exchanged with a network, over a protocol and a range of ports.
+// The network and the ports are the ones of the remote end, that is the destination of the
+// packets from the client, and the source of the packets to it.
+type ACLRule struct {
+	Action   ACLAction
+	Network  *net.IPNet // Network is the network of the remote end, nil for any
+	Protocol byte       // Protocol is the IP protocol number, 0 for any
+	FromPort uint16     // FromPort is the first port of the remote end, 0 for any port
+	ToPort   uint16     // ToPort is the last port, FromPort if 0
+}
+
+// matches method reports whether the rule matches a packet exchanged with the remote address.
+// port is the port of the remote end, if the packet has ports.
+func (r *ACLRule) matches(remote net.IP, proto byte, port uint16, hasPorts bool) bool {
+	if r.Network != nil && !r.Network.Contains(remote) {
+		return false
+	}
+	if r.Protocol != 0 && r.Protocol != proto {
+		return false
+	}
+	if r.FromPort == 0 {
+		return true
+	}
+
+	to := r.ToPort
+	if to == 0 {
+		to = r.FromPort
+	}
+	return hasPorts && port >= r.FromPort && port <= to
+}
+
+// ACL filters the packets exchanged by a client. The packets are matched against the rules in
+// turn, the first matching rule decides, and Default decides the packets matching none.
+// The packets are filtered one by one, so the replies have to be allowed as well, which they
+// are by a rule allowing the packets to a service, as the rules apply both ways.
+type ACL struct {
+	Rules   []ACLRule
+	Default ACLAction // Default is the action for the packets matching no rule
+}
+
+// allows method reports whether a packet is let through. toClient is set for the packets to
+// the client, and unset for the ones from it.
+func (a *ACL) allows(p []byte, toClient bool) bool {
+	var remote net.IP
+	var ok bool
+	if toClient {
+		remote, ok = packetSource(p)
+	} else {
+		remote, ok = packetDestination(p)
+	}
+	if !ok {
+		return false
+	}
+
+	proto, src, dst, hasPorts := packetPorts(p)
+	port := dst
+	if toClient {
+		port = src
+	}
+
+	for i := range a.Rules {
+		if a.Rules[i].matches(remote, proto, port, hasPorts) {
+			return a.Rules[i].Action == ACLAllow
+		}
+	}
+	return a.Default == ACLAllow
+}
@@ -0,0 +1,141 @@
+package pinlib
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// portPacket returns an IPv4 or IPv6 packet, as per the addresses, of the transport protocol
+// proto, carrying just the ports.
+func portPacket(proto byte, src, dst string, sport, dport uint16) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	var p []byte
+	if srcIP.To4() != nil {
+		p = ipv4Packet(srcIP, dstIP)
+		p[9] = proto
+	} else {
+		p = make([]byte, 40)
+		p[0] = 0x60
+		p[6] = proto
+		copy(p[8:24], srcIP)
+		copy(p[24:40], dstIP)
+	}
+
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, sport)
+	binary.BigEndian.PutUint16(ports[2:], dport)
+	return append(p, ports...)
+}
+
+// fragment returns a copy of an IPv4 packet with the fragment offset set.
+func fragment(p []byte, offset uint16) []byte {
+	p = append([]byte(nil), p...)
+	binary.BigEndian.PutUint16(p[6:8], offset)
+	return p
+}
+
+// headerLength returns a copy of an IPv4 packet with the header length set, in 32 bit words.
+func headerLength(p []byte, ihl byte) []byte {
+	p = append([]byte(nil), p...)
+	p[0] = 0x40 | ihl
+	return p
+}
+
+func TestPacketPorts(t *testing.T) {
+	tcp := portPacket(protoTCP, "10.0.0.2", "10.1.0.5", 40000, 80)
+	for _, tc := range []struct {
+		name     string
+		packet   []byte
+		proto    byte
+		src, dst uint16
+		hasPorts bool
+	}{
+		{"tcp", tcp, protoTCP, 40000, 80, true},
+		{"udp", portPacket(protoUDP, "10.0.0.2", "10.1.0.5", 53, 5353), protoUDP, 53, 5353, true},
+		{"ipv6", portPacket(protoTCP, "fd00::2", "fd00:1::5", 40000, 443), protoTCP, 40000, 443, true},
+		{"icmp", portPacket(1, "10.0.0.2", "10.1.0.5", 0, 0), 1, 0, 0, false},
+		{"first fragment", fragment(tcp, 0x2000), protoTCP, 40000, 80, true},
+		{"non-first fragment", fragment(tcp, 0x2001), protoTCP, 0, 0, false},
+		{"options", headerLength(append(tcp[:20:20], append(make([]byte, 4), tcp[20:]...)...), 6), protoTCP, 40000, 80, true},
+		{"truncated", tcp[:22], protoTCP, 0, 0, false},
+		{"header length 0", headerLength(tcp, 0), 0, 0, 0, false},
+		{"header length 4", headerLength(tcp, 4), 0, 0, 0, false},
+		{"header past the end", headerLength(tcp, 15), protoTCP, 0, 0, false},
+		{"short ipv4", tcp[:19], 0, 0, 0, false},
+		{"short ipv6", portPacket(protoTCP, "fd00::2", "fd00:1::5", 1, 2)[:39], 0, 0, 0, false},
+		{"unknown version", append([]byte{0x50}, tcp[1:]...), 0, 0, 0, false},
+		{"empty", nil, 0, 0, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proto, src, dst, hasPorts := packetPorts(tc.packet)
+			if proto != tc.proto || src != tc.src || dst != tc.dst || hasPorts != tc.hasPorts {
+				t.Fatalf("got %d %d %d %v, want %d %d %d %v", proto, src, dst, hasPorts, tc.proto, tc.src, tc.dst, tc.hasPorts)
+			}
+		})
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+	_, web, _ := net.ParseCIDR("10.1.0.0/16")
+	_, dns, _ := net.ParseCIDR("10.1.2.3/32")
+	_, lab, _ := net.ParseCIDR("10.2.0.0/16")
+	_, web6, _ := net.ParseCIDR("fd00:1::/64")
+	acl := &ACL{
+		Rules: []ACLRule{
+			{Action: ACLDeny, Network: dns, Protocol: protoUDP, FromPort: 53},
+			{Action: ACLAllow, Network: web, Protocol: protoTCP, FromPort: 80, ToPort: 89},
+			{Action: ACLAllow, Network: web6, Protocol: protoTCP, FromPort: 443},
+			{Action: ACLAllow, Network: dns, Protocol: protoUDP},
+			{Action: ACLAllow, Network: lab},
+		},
+		Default: ACLDeny,
+	}
+
+	request := portPacket(protoTCP, "10.0.0.2", "10.1.0.5", 40000, 80)
+	for _, tc := range []struct {
+		name     string
+		packet   []byte
+		toClient bool
+		want     bool
+	}{
+		{"first port", request, false, true},
+		{"last port", portPacket(protoTCP, "10.0.0.2", "10.1.0.5", 40000, 89), false, true},
+		{"below the range", portPacket(protoTCP, "10.0.0.2", "10.1.0.5", 40000, 79), false, false},
+		{"above the range", portPacket(protoTCP, "10.0.0.2", "10.1.0.5", 40000, 90), false, false},
+		{"other protocol", portPacket(protoUDP, "10.0.0.2", "10.1.0.5", 40000, 80), false, false},
+		{"other network", portPacket(protoTCP, "10.0.0.2", "10.3.0.5", 40000, 80), false, false},
+		{"reply", portPacket(protoTCP, "10.1.0.5", "10.0.0.2", 80, 40000), true, true},
+		{"to the client's port", portPacket(protoTCP, "10.1.0.5", "10.0.0.2", 40000, 80), true, false},
+		{"denied before allowed", portPacket(protoUDP, "10.0.0.2", "10.1.2.3", 40000, 53), false, false},
+		{"denied reply", portPacket(protoUDP, "10.1.2.3", "10.0.0.2", 53, 40000), true, false},
+		{"rule without ports", portPacket(protoUDP, "10.0.0.2", "10.1.2.3", 40000, 5353), false, true},
+		{"any protocol", portPacket(1, "10.2.0.9", "10.0.0.2", 0, 0), true, true},
+		{"ipv6", portPacket(protoTCP, "fd00::2", "fd00:1::5", 40000, 443), false, true},
+		{"ipv6 reply", portPacket(protoTCP, "fd00:1::5", "fd00::2", 443, 40000), true, true},
+		{"ipv6 other port", portPacket(protoTCP, "fd00::2", "fd00:1::5", 40000, 80), false, false},
+		{"first fragment", fragment(request, 0x2000), false, true},
+		{"non-first fragment", fragment(request, 0x2001), false, false},
+		{"non-first fragment of any port", fragment(portPacket(protoTCP, "10.0.0.2", "10.2.0.9", 1, 2), 0x2001), false, true},
+		{"truncated", request[:22], false, false},
+		{"header length 4", headerLength(request, 4), false, false},
+		{"header length 0", headerLength(request, 0), false, false},
+		{"short", request[:19], false, false},
+		{"empty", nil, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := acl.allows(tc.packet, tc.toClient); got != tc.want {
+				t.Fatalf("allowed %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	// the default decides the packets matching no rule
+	open := &ACL{Rules: acl.Rules, Default: ACLAllow}
+	if !open.allows(portPacket(protoTCP, "10.0.0.2", "10.3.0.5", 40000, 80), false) {
+		t.Fatal("a packet matching no rule was dropped by a default allow")
+	}
+	if open.allows(portPacket(protoUDP, "10.0.0.2", "10.1.2.3", 40000, 53), false) {
+		t.Fatal("a packet matching a deny rule was let through by a default allow")
+	}
+}
@@ -0,0 +1,35 @@
+package pinlib
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff specifies the delays between the attempts of a client to reconnect.
+// The delay doubles with every failed attempt, from Initial up to Max.
+type Backoff struct {
+	Initial time.Duration // Initial is the delay before the second attempt, the first one is made right away
+	Max     time.Duration // Max is the longest delay between two attempts
+}
+
+// DefaultBackoff is the Backoff used by clients which don't specify one.
+var DefaultBackoff = Backoff{Initial: time.Second, Max: time.Minute}
+
+// delay method returns how long to wait before the given attempt, counted from 1.
+// The delay is jittered to anywhere between half and all of it, so clients dropped
+// together by a server restart don't reconnect in lockstep.
+func (b Backoff) delay(attempt int) time.Duration {
+	if attempt <= 1 || b.Initial <= 0 {
+		return 0
+	}
+
+	d := b.Initial
+	for i := 2; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
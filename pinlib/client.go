@@ -2,96 +2,425 @@ package pinlib
 
 import (
 	"errors"
-	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Client struct contains all fields for exchanging packets to the server through a TCP connection
+// Lease holds the address leased to the client along with the settings pushed by the server
+type Lease struct {
+	Address  *net.IPNet // Address is the leased address along with the prefix of the tunnel network
+	Gateway  net.IP     // Gateway is the address of the server in the tunnel network
+	Address6 *net.IPNet // Address6 is the leased IPv6 address, nil if the tunnel is IPv4 only
+	Gateway6 net.IP     // Gateway6 is the IPv6 address of the server in the tunnel network
+	PushConfig
+
+	Subnets []*net.IPNet // Subnets are the subnets advertised by the client which the server accepted
+
+	Endpoint   string   // Endpoint is the endpoint of the server the lease is from, as configured
+	RemoteAddr net.Addr // RemoteAddr is the address the endpoint resolved to
+}
+
+// ClientState is the state of the connection of a Client to the remote pin
+type ClientState int
+
+// All the states reported to Client.OnState
+const (
+	ClientConnecting   ClientState = iota // the first connection is being made
+	ClientConnected                       // the connection is made, or was made again after being lost
+	ClientReconnecting                    // the connection was lost, and is being made again
+)
+
+// String method implements the stringer interface
+func (s ClientState) String() string {
+	switch s {
+	case ClientConnecting:
+		return "connecting"
+	case ClientConnected:
+		return "connected"
+	case ClientReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// ErrMaxAttempts is returned by Client.Start when the connection was lost and couldn't be made again
+// within Client.MaxAttempts attempts.
+var ErrMaxAttempts = errors.New("maximum reconnect attempts reached")
+
+// Client struct contains all fields for exchanging packets to the server through a TCP or UDP connection
 type Client struct {
 	// Unexported
-	iface  io.ReadWriter // handler for the tunneling interface
-	secret [32]byte
-	conn   *CounterConn
+	iface     io.ReadWriter // handler for the tunneling interface
+	secret    [32]byte
+	smu       sync.Mutex // guards conn and session, set once the first connection is made
+	conn      *CounterConn
+	session   *resumableConn
+	lease     *Lease   // lease of the session, kept across reconnects
+	token     []byte   // token the session is resumed with, nil if the server doesn't issue one
+	endpoints []string // endpoints in the order they are tried
+	active    int      // index of the endpoint connected to
 
 	// Exported
-	Remote string                    // Remote is the IP:PORT combination of the remote pin
-	Hook   func(ip, gw string) error // Hook is a function that runs immediately after the TCP connection is made
-	close  chan bool
+	Remote    string                   // Remote is the IP:PORT combination of the remote pin
+	Endpoints []string                 // Endpoints are the IP:PORT combinations of the remote pins to fail over between, Remote if empty
+	Transport string                   // Transport is the transport to connect over, TransportTCP or TransportUDP
+	User      string                   // User is the name the client identifies as, empty if the secret is shared
+	Key       *[32]byte                // Key is the static X25519 private key of the client, nil if not authenticating with one
+	Hook      func(lease *Lease) error // Hook is a function that runs immediately after the connection is made
+	Rekey     RekeyPolicy              // Rekey specifies when the session keys are rotated
+	close     chan bool
+
+	// PreferredIP is the IPv4 address asked for when requesting a lease. The server leases another
+	// one if it is taken or reserved for another client. Once leased an address, the client asks
+	// for that one again whenever it has to request a new lease. nil to take any address.
+	PreferredIP net.IP
+
+	// Subnets are the subnets behind the client, advertised to the server for site to site tunnels.
+	// The server routes the packets to the ones it accepts to the client.
+	Subnets []*net.IPNet
+
+	// MaxAttempts is the number of attempts made to connect again after the connection is lost,
+	// before Start gives up. If 0, the client keeps trying.
+	MaxAttempts int
+	Backoff     Backoff                 // Backoff specifies the delays between the attempts
+	OnState     func(state ClientState) // OnState is called whenever the state of the connection changes
+
+	Keepalive Keepalive // Keepalive specifies how a dead server is noticed, which is then reconnected to
+
+	// HandshakeTimeout is how long an endpoint has to accept the connection and go through with the
+	// handshake, before the next one is tried.
+	HandshakeTimeout time.Duration
+
+	// RandomEndpoints has the endpoints tried in a random order, picked once per Start, so that
+	// clients spread over the servers. They are tried in the order given otherwise.
+	RandomEndpoints bool
 }
 
 // NewClient is used to create a new client which makes a connection to the remote pin.
 func NewClient(remote string, iface io.ReadWriter, secret [32]byte) *Client {
 	// if number of connections is 0 it is pointless to run this VPN
 
-	return &Client{iface: iface, Remote: remote, secret: secret, Hook: func(ip, gw string) error { return nil }, close: make(chan bool)}
+	return &Client{iface: iface, Remote: remote, secret: secret, Transport: TransportTCP, Hook: func(lease *Lease) error { return nil }, Rekey: DefaultRekeyPolicy, Backoff: DefaultBackoff, Keepalive: DefaultKeepalive, HandshakeTimeout: DefaultHandshakeTimeout, OnState: func(state ClientState) {}, close: make(chan bool)}
 }
 
-// Start method makes TCP connections and starts the packet exchange from the local tunneling interface to the remote interface.
-// This also makes Client struct to satisfy the pinlib.Peer interface.
-func (c *Client) Start() error {
-	// wait group to wait for all go routines to complete
-	wg := &sync.WaitGroup{}
-
-	defer log.Printf("Closing Connection to %s\n", c.Remote)
+// orderEndpoints method sets the order the endpoints are tried in.
+func (c *Client) orderEndpoints() {
+	c.endpoints = append([]string{}, c.Endpoints...)
+	if len(c.endpoints) == 0 {
+		c.endpoints = []string{c.Remote}
+	}
+	if c.RandomEndpoints {
+		rand.Shuffle(len(c.endpoints), func(i, j int) {
+			c.endpoints[i], c.endpoints[j] = c.endpoints[j], c.endpoints[i]
+		})
+	}
+	c.active = 0
+}
 
-	log.Printf("Dialing %s\n", c.Remote)
-	cx, err := net.Dial("tcp", c.Remote)
+// connect method dials an endpoint and runs the key exchange over the new connection. The
+// connection is left with the deadline of the handshake, which the caller clears once done.
+func (c *Client) connect(endpoint string) (*CryptoConn, error) {
+	log.Printf("Dialing %s over %s\n", endpoint, c.Transport)
+	cx, err := dial(c.Transport, endpoint, c.HandshakeTimeout)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Printf("Dial Successful\n")
-	conn := NewCryptoConn(cx, c.secret)
+	if c.HandshakeTimeout > 0 {
+		cx.SetDeadline(time.Now().Add(c.HandshakeTimeout))
+	}
+	rc := newTransportRecordConn(c.Transport, cx)
+
+	keys, err := clientKeyExchange(rc, c.User, c.secret, c.Key)
+	if err != nil {
+		cx.Close()
+		return nil, errors.New("Error while key exchange: " + err.Error())
+	}
 
+	conn, err := NewCryptoConn(rc, keys, c.Rekey)
+	if err != nil {
+		cx.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// requestLease method makes a new connection and requests an address for a new session. The endpoints
+// are tried in turn from the given one, till one of them leases an address, which becomes the active one.
+// The token the session can be resumed with is returned too, nil if the server doesn't issue one.
+func (c *Client) requestLease(from int) (*CryptoConn, *Lease, []byte, error) {
+	var err error
+	for i := range c.endpoints {
+		n := (from + i) % len(c.endpoints)
+		endpoint := c.endpoints[n]
+
+		var conn *CryptoConn
+		conn, err = c.connect(endpoint)
+		if err != nil {
+			log.Printf("Connecting to %s failed: %s\n", endpoint, err)
+			continue
+		}
+
+		var lease *Lease
+		var token []byte
+		lease, token, err = c.handshake(conn)
+		if err != nil {
+			log.Printf("Handshake with %s failed: %s\n", endpoint, err)
+			conn.Close()
+			continue
+		}
+		conn.SetDeadline(time.Time{})
+
+		lease.Endpoint, lease.RemoteAddr = endpoint, conn.RemoteAddr()
+		c.active = n
+		return conn, lease, token, nil
+	}
+	return nil, nil, nil, err
+}
+
+// handshake method requests an address over a new connection.
+func (c *Client) handshake(conn *CryptoConn) (*Lease, []byte, error) {
 	log.Printf("Starting IP Handshake\n")
-	_, err = conn.Write([]byte("IPPLS"))
+	req := newMessage(msgLeaseRequest)
+	preferred := c.PreferredIP
+	if c.lease != nil {
+		preferred = c.lease.Address.IP
+	}
+	if preferred.To4() != nil {
+		req.set(optRequestedIPv4, []byte(preferred.To4()))
+	}
+	if len(c.Subnets) > 0 {
+		req.set(optSubnets, encodeNets(c.Subnets))
+	}
+	err := writeMessage(conn, req)
 	if err != nil {
-		return errors.New("Error while handshake: " + err.Error())
+		return nil, nil, errors.New("Error while handshake: " + err.Error())
 	}
 
-	ipp := make([]byte, 9)
+	reply, err := readMessage(conn, msgLeaseReply)
+	if err != nil {
+		log.Printf("Handshake unsuccessful: %s\n", err)
+		return nil, nil, err
+	}
+
+	ipp, ok := reply.get(optIPv4)
+	if !ok || len(ipp) != 5 {
+		return nil, nil, errors.New("invalid handshake: no IPv4 address leased")
+	}
+
+	gw, ok := reply.get(optGateway)
+	if !ok || len(gw) != 4 {
+		return nil, nil, errors.New("invalid handshake: no gateway")
+	}
+
+	lease := &Lease{
+		Address: &net.IPNet{IP: net.IP(ipp[:4]), Mask: net.CIDRMask(int(ipp[4]), 32)},
+		Gateway: net.IP(gw),
+	}
+
+	if ipp6, ok := reply.get(optIPv6); ok {
+		gw6, _ := reply.get(optGateway6)
+		if len(ipp6) != 17 || int(ipp6[16]) > 128 || len(gw6) != 16 {
+			return nil, nil, errors.New("invalid handshake: malformed IPv6 lease")
+		}
+		lease.Address6 = &net.IPNet{IP: net.IP(ipp6[:16]), Mask: net.CIDRMask(int(ipp6[16]), 128)}
+		lease.Gateway6 = net.IP(gw6)
+	}
 
-	n, err := conn.Read(ipp)
+	err = lease.PushConfig.get(reply)
 	if err != nil {
-		log.Printf("Error while reading handshake data\n")
-		return err
+		return nil, nil, errors.New("invalid handshake: " + err.Error())
 	}
 
-	if n == 1 && ipp[0] == 0 {
-		log.Printf("Handshake unsuccessful: no IPs available for lease\n")
-		return errors.New("no IPs available on the server")
+	if p, ok := reply.get(optSubnets); ok {
+		lease.Subnets, err = decodeNets(p)
+		if err != nil {
+			return nil, nil, errors.New("invalid handshake: " + err.Error())
+		}
 	}
 
-	if n != 9 {
-		log.Printf("Handshake unsuccessful: invalid handshake data length\n")
-		return errors.New("invalid handshake")
+	// servers issuing a session token let the session be resumed over a new connection
+	token, ok := reply.get(optSessionToken)
+	if !ok || len(token) != sessionTokenSize {
+		token = nil
 	}
 
-	conn.Write([]byte{1})
-	subnetIP := fmt.Sprintf("%d.%d.%d.%d", ipp[0], ipp[1], ipp[2], ipp[3])
+	err = writeMessage(conn, newMessage(msgLeaseAck))
+	if err != nil {
+		return nil, nil, errors.New("Error while handshake: " + err.Error())
+	}
+	endHandshake(conn)
 
 	log.Printf("Handshake successful\n")
-	log.Printf("VPC IP leased : %s", subnetIP)
+	log.Printf("VPC IP leased : %s", lease.Address.IP)
+
+	return lease, token, nil
+}
+
+// resume method makes a new connection to the active endpoint and resumes the session of the token over it.
+// The lease of the session is kept, so the hook is not run again.
+func (c *Client) resume(token []byte) (*CryptoConn, error) {
+	conn, err := c.connect(c.endpoints[c.active])
+	if err != nil {
+		return nil, err
+	}
+
+	m := newMessage(msgResume)
+	m.set(optSessionToken, token)
+	err = writeMessage(conn, m)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := readMessage(conn, msgResumeReply)
+	if err != nil {
+		conn.Close()
+		if reply != nil && reply.typ == msgError {
+			return nil, ErrUnknownSession
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	endHandshake(conn)
+	return conn, nil
+}
+
+// reconnect method makes the connection of the session again after it is lost, waiting longer
+// after every failed attempt. The session is resumed if the server still holds it, otherwise
+// a new address is requested. The hook is run again only if the new lease differs from the
+// previous one, the tunneling interface and the routes stay in place otherwise.
+func (c *Client) reconnect() {
+	c.OnState(ClientReconnecting)
+
+	for attempt := 1; c.MaxAttempts == 0 || attempt <= c.MaxAttempts; attempt++ {
+		select {
+		case <-c.session.closed:
+			return
+		case <-time.After(c.Backoff.delay(attempt)):
+		}
 
-	cc := &CounterConn{conn: conn}
+		log.Printf("Reconnecting (attempt %d)\n", attempt)
+		conn, err := c.reconnectOnce()
+		if err != nil {
+			log.Printf("Reconnect failed: %s\n", err)
+			continue
+		}
+
+		if !c.session.resume(conn) {
+			conn.Close()
+			return
+		}
+		log.Printf("Reconnected to %s\n", c.endpoints[c.active])
+		c.OnState(ClientConnected)
+		return
+	}
 
+	log.Printf("Giving up reconnecting\n")
+	c.session.giveUp()
+}
+
+// reconnectOnce method makes a single attempt to connect again. The session is resumed with the
+// active endpoint. Failing that, a new lease is requested, from the next endpoint on if the active
+// one is not reachable.
+func (c *Client) reconnectOnce() (*CryptoConn, error) {
+	from := c.active
+	if c.token != nil {
+		conn, err := c.resume(c.token)
+		if err == nil {
+			return conn, nil
+		}
+		if err == ErrUnknownSession {
+			log.Printf("Session expired, requesting a new lease\n")
+		} else {
+			from++
+		}
+	}
+
+	conn, lease, token, err := c.requestLease(from)
+	if err != nil {
+		return nil, err
+	}
+	c.token = token
+
+	if !lease.same(c.lease) {
+		err = c.Hook(lease)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	c.lease = lease
+	return conn, nil
+}
+
+// same method reports whether two leases are of the same addresses, from the same server.
+// The interface and the routes set up for one then hold for the other too.
+func (l *Lease) same(o *Lease) bool {
+	return l.Address.String() == o.Address.String() && l.Gateway.Equal(o.Gateway) &&
+		l.Address6.String() == o.Address6.String() && l.Gateway6.Equal(o.Gateway6) &&
+		l.Endpoint == o.Endpoint && l.RemoteAddr.String() == o.RemoteAddr.String() &&
+		sameNets(l.Subnets, o.Subnets)
+}
+
+// sameNets reports whether two lists hold the same networks, in the same order.
+func sameNets(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// Start method makes a connection over the configured transport and starts the packet exchange from the local tunneling interface to the remote interface.
+// If the connection is lost, it is made again with the session resumed if possible, until Close is called or MaxAttempts is reached.
+// This also makes Client struct to satisfy the pinlib.Peer interface.
+func (c *Client) Start() error {
+	// wait group to wait for all go routines to complete
+	wg := &sync.WaitGroup{}
+
+	defer log.Printf("Closing Connection\n")
+
+	c.orderEndpoints()
+	c.OnState(ClientConnecting)
+	conn, lease, token, err := c.requestLease(0)
+	if err != nil {
+		return err
+	}
+	c.lease, c.token = lease, token
+
+	rconn := newClientResumableConn(conn, c.reconnect)
+	cc := &CounterConn{conn: rconn}
+
+	c.smu.Lock()
 	c.conn = cc
+	c.session = rconn
+	c.smu.Unlock()
 
 	ex := &Exchanger{conn: cc, iface: c.iface}
+	go rconn.keepalive(c.Keepalive)
 
 	go func() {
 		for !<-c.close {
 		}
-		ex.running = false
-		conn.Close()
+		ex.stop()
+		rconn.Close()
 	}()
 
+	c.OnState(ClientConnected)
+
 	// this is where the hook function is run.
 	// Generally for a pinlib based VPN program, this Hook function should be configured with IP routing and device setup
-	err = c.Hook(fmt.Sprintf("%d.%d.%d.%d/%d", ipp[0], ipp[1], ipp[2], ipp[3], ipp[4]),
-		fmt.Sprintf("%d.%d.%d.%d", ipp[5], ipp[6], ipp[7], ipp[8]))
+	err = c.Hook(lease)
 	if err != nil {
 		return err
 	}
@@ -103,9 +432,15 @@ func (c *Client) Start() error {
 	}()
 	wg.Wait()
 
-	conn.Close()
+	// the exchange stops either when the client is closed, or when reconnecting is given up
+	select {
+	case <-rconn.closed:
+		return nil
+	default:
+	}
 
-	return nil
+	rconn.Close()
+	return ErrMaxAttempts
 }
 
 func (c *Client) Close() {
@@ -113,11 +448,23 @@ func (c *Client) Close() {
 }
 
 type TxnStat struct {
-	In, Out uint64
+	In, Out  uint64
+	Replayed uint64 // packets dropped by the replay protection
+	Dropped  uint64 // datagrams dropped for failing to authenticate
 }
 
+// GetTxnStat method returns the transfer numbers of the session.
+// The packets dropped are counted over every connection of the session, across resumes and reconnects.
+// nil is returned till the first connection is made.
 func (c *Client) GetTxnStat() *TxnStat {
-	return &TxnStat{In: c.conn.BytesIn, Out: c.conn.BytesOut}
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	if c.session == nil {
+		return nil
+	}
+
+	drops := c.session.replayStat()
+	return &TxnStat{In: atomic.LoadUint64(&c.conn.BytesIn), Out: atomic.LoadUint64(&c.conn.BytesOut), Replayed: drops.Replayed, Dropped: drops.Dropped}
 }
 
 type CounterConn struct {
@@ -127,11 +474,11 @@ type CounterConn struct {
 
 func (cc *CounterConn) Read(p []byte) (int, error) {
 	n, err := cc.conn.Read(p)
-	cc.BytesIn += uint64(n)
+	atomic.AddUint64(&cc.BytesIn, uint64(n))
 	return n, err
 }
 
 func (cc *CounterConn) Write(p []byte) (int, error) {
-	cc.BytesOut += uint64(len(p))
+	atomic.AddUint64(&cc.BytesOut, uint64(len(p)))
 	return cc.conn.Write(p)
 }
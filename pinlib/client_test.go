@@ -0,0 +1,39 @@
+package pinlib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestClientHandshakeTimeout checks a silent endpoint is given up on, and the next one tried.
+func TestClientHandshakeTimeout(t *testing.T) {
+	// accepts the connections, never answers them
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			cx, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer cx.Close()
+		}
+	}()
+
+	var secret [32]byte
+	c := NewClient(silent.Addr().String(), nil, secret)
+	c.HandshakeTimeout = 200 * time.Millisecond
+	c.orderEndpoints()
+
+	start := time.Now()
+	if _, _, _, err := c.requestLease(0); err == nil {
+		t.Fatal("a silent endpoint leased an address")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gave up after %s, want about %s", elapsed, c.HandshakeTimeout)
+	}
+}
@@ -2,8 +2,13 @@ package pinlib
 
 import (
 	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/snappy"
@@ -40,42 +45,229 @@ func (cc *CompressorConn) Write(p []byte) (int, error) {
 }
 
 // CryptoConn is a net.Conn wrapper that decrypts the read data
-// and encrypts the written data. Here ChaCha20+Poly1305 cipher/authentication is used.
+// and encrypts the written data. Here ChaCha20+Poly1305 cipher/authentication is used
+// with separate keys for either direction of the session.
+//
+// Every sealed packet carries its key epoch and sequence number, which are also bound
+// into the additional data. Packets replayed or too old for the replay window are dropped.
+// The sending side moves to the next epoch as per the RekeyPolicy, and the receiving side
+// follows as soon as it sees a packet of the new epoch.
 type CryptoConn struct {
-	key      [32]byte
-	nonce    [12]byte
-	nonceGen *Rng
-	crypter  cipher.AEAD
+	policy RekeyPolicy
+
+	// sending side
+	wmu        sync.Mutex
+	nonceGen   *NonceGenerator
+	sendKey    [32]byte
+	sendEpoch  uint8
+	epochStart time.Time
+	epochBytes uint64
+	sealer     cipher.AEAD
+
+	// receiving side
+	recvKey        [32]byte
+	recvEpoch      uint8
+	opener         cipher.AEAD
+	ahead          []epochKey  // keys of the epochs after recvEpoch, derived once they are first seen
+	previous       cipher.AEAD // opener of the epoch left last, valid till previousExpiry
+	previousEpoch  uint8
+	previousExpiry time.Time
+	window         replayWindow
+	datagram       bool        // packets failing to authenticate are dropped, instead of failing the Read
+	roam           roamingConn // told about every authenticated packet, nil if the connection doesn't roam
+
+	// unix nano timestamps of the last packet sent and authenticated, for the keepalives
+	lastSent     int64
+	lastReceived int64
+
+	Replayed uint64 // number of packets dropped by the replay window
+	Dropped  uint64 // number of packets dropped for failing to authenticate over datagram transports
 	net.Conn
 }
 
-// NewCryptoConn creates a new CryptoConn struct
-func NewCryptoConn(conn net.Conn, secret [32]byte) *CryptoConn {
-	c := &CryptoConn{Conn: NewCompressorConn(conn)}
-	copy(c.key[:], secret[:32])
-	c.nonceGen = NewRng(time.Now().Unix())
-	c.crypter, _ = chacha20poly1305.New(c.key[:])
-	return c
+// NewCryptoConn creates a new CryptoConn struct on top of a record layer
+// using the session keys negotiated during the key exchange.
+func NewCryptoConn(conn *RecordConn, keys SessionKeys, policy RekeyPolicy) (*CryptoConn, error) {
+	var err error
+	c := &CryptoConn{Conn: conn, policy: policy, nonceGen: NewNonceGenerator(), epochStart: time.Now()}
+	c.sendKey, c.recvKey = keys.Send, keys.Recv
+	_, c.datagram = conn.Conn.(datagramConn)
+	c.roam, _ = conn.Conn.(roamingConn)
+	touch(&c.lastSent)
+	touch(&c.lastReceived)
+	c.sealer, err = chacha20poly1305.New(c.sendKey[:])
+	if err != nil {
+		return nil, err
+	}
+	c.opener, err = chacha20poly1305.New(c.recvKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // Read method implements io.Reader interface for the CryptoConn
-// Data read is decrypted.
+// Data read is decrypted. Every Read returns exactly one sealed packet, empty ones are skipped.
 func (ac *CryptoConn) Read(b []byte) (int, error) {
-	out := make([]byte, len(b)+16+12)
-	rd, err := ac.Conn.Read(out)
+	out := make([]byte, len(b)+sealOverhead)
+	for {
+		rd, err := ac.Conn.Read(out)
+		if err != nil {
+			return 0, err
+		}
+
+		if rd < sealOverhead {
+			if ac.datagram {
+				atomic.AddUint64(&ac.Dropped, 1)
+				continue
+			}
+			return 0, errors.New("sealed packet too short")
+		}
+
+		x, seq, err := ac.open(out[:rd])
+		if err == errStaleEpoch {
+			atomic.AddUint64(&ac.Replayed, 1)
+			continue
+		}
+		if err != nil {
+			if ac.datagram {
+				atomic.AddUint64(&ac.Dropped, 1)
+				continue
+			}
+			return 0, err
+		}
+
+		if !ac.window.accept(seq) {
+			atomic.AddUint64(&ac.Replayed, 1)
+			continue
+		}
+
+		// only fresh, authenticated packets may move a roaming connection, a replayed one
+		// sent from another address would redirect the session otherwise.
+		if ac.roam != nil {
+			ac.roam.authenticated()
+		}
+
+		// empty packets are keepalives, they are not passed on
+		touch(&ac.lastReceived)
+		if len(x) == 0 {
+			continue
+		}
+
+		return copy(b, x), nil
+	}
+}
+
+var errStaleEpoch = errors.New("packet sealed with an expired key")
+
+// epochKey is the receiving key of an epoch and its opener.
+type epochKey struct {
+	key    [32]byte
+	opener cipher.AEAD
+}
+
+// open method authenticates and decrypts a sealed packet in place with the key of its epoch.
+// The receiving side moves to the epoch of a packet ahead only once it is authenticated,
+// skipping the epochs in between should all their packets have been lost.
+func (ac *CryptoConn) open(p []byte) ([]byte, uint64, error) {
+	hdr := p[:cryptoHeaderSize]
+	epoch := hdr[0]
+	seq := binary.BigEndian.Uint64(hdr[1:])
+	nonce := sequenceNonce(seq)
+
+	opener := ac.opener
+	ahead := epoch - ac.recvEpoch
+	switch {
+	case ahead == 0:
+	case ahead <= maxEpochSkip:
+		for len(ac.ahead) < int(ahead) {
+			key := ac.recvKey
+			if len(ac.ahead) > 0 {
+				key = ac.ahead[len(ac.ahead)-1].key
+			}
+			next, err := nextKey(key)
+			if err != nil {
+				return nil, 0, err
+			}
+			aead, err := chacha20poly1305.New(next[:])
+			if err != nil {
+				return nil, 0, err
+			}
+			ac.ahead = append(ac.ahead, epochKey{key: next, opener: aead})
+		}
+		opener = ac.ahead[ahead-1].opener
+	case ac.previous != nil && epoch == ac.previousEpoch:
+		if time.Now().After(ac.previousExpiry) {
+			return nil, 0, errStaleEpoch
+		}
+		opener = ac.previous
+	case ac.recvEpoch-epoch <= maxEpochSkip:
+		return nil, 0, errStaleEpoch
+	default:
+		return nil, 0, fmt.Errorf("packet sealed with the key of an unknown epoch %d", epoch)
+	}
+
+	x, err := opener.Open(p[cryptoHeaderSize:cryptoHeaderSize], nonce[:], p[cryptoHeaderSize:], hdr)
 	if err != nil {
-		return rd, err
+		return nil, 0, err
+	}
+
+	if ahead > 0 && ahead <= maxEpochSkip {
+		next := ac.ahead[ahead-1]
+		ac.previous, ac.previousEpoch, ac.previousExpiry = ac.opener, ac.recvEpoch, time.Now().Add(ac.policy.Grace)
+		ac.opener, ac.recvKey, ac.recvEpoch = next.opener, next.key, epoch
+		ac.ahead = ac.ahead[ahead:]
 	}
 
-	x, err := ac.crypter.Open(nil, out[:12], out[12:rd], nil)
-	copy(b[:], x[:])
-	return len(x), err
+	return x, seq, nil
 }
 
 // Write method implements io.Writer interface for the CryptoConn
-// Data written is encrypted.
+// Data written is encrypted and sent as a single record.
 func (ac *CryptoConn) Write(b []byte) (int, error) {
-	ac.nonce = ac.nonceGen.RandomNonceGenerator()
-	out := ac.crypter.Seal(ac.nonce[:], ac.nonce[:], b, nil)
-	return ac.Conn.Write(out)
+	ac.wmu.Lock()
+	defer ac.wmu.Unlock()
+
+	if ac.policy.due(ac.epochStart, ac.epochBytes) {
+		err := ac.rekey()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	seq, nonce, err := ac.nonceGen.Next()
+	if err != nil {
+		return 0, err
+	}
+
+	out := make([]byte, cryptoHeaderSize, len(b)+sealOverhead)
+	out[0] = ac.sendEpoch
+	binary.BigEndian.PutUint64(out[1:], seq)
+	out = ac.sealer.Seal(out, nonce[:], b, out[:cryptoHeaderSize])
+	_, err = ac.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+
+	touch(&ac.lastSent)
+	ac.epochBytes += uint64(len(b))
+	return len(b), nil
+}
+
+// rekey method moves the sending side to the key of the next epoch.
+func (ac *CryptoConn) rekey() error {
+	key, err := nextKey(ac.sendKey)
+	if err != nil {
+		return err
+	}
+
+	sealer, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return err
+	}
+
+	ac.sendKey, ac.sealer = key, sealer
+	ac.sendEpoch++
+	ac.epochStart, ac.epochBytes = time.Now(), 0
+	return nil
 }
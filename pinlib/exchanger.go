@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"sync/atomic"
 )
 
 // Exchanger is the main struct used to enable IP packet transfer between 2 peers
@@ -12,16 +13,28 @@ import (
 type Exchanger struct {
 	conn    io.ReadWriter
 	iface   io.ReadWriter
-	running bool
+	running int32        // set while exchanging, read and written by both directions
+	ingress *tokenBucket // limits the packets from the connection, nil for no limit
+	egress  *tokenBucket // limits the packets to the connection, nil for no limit
 }
 
 // Start method starts the IP packet exchange between the configured interface and the TCP connection
 func (p *Exchanger) Start() {
-	p.running = true
+	atomic.StoreInt32(&p.running, 1)
 	go p.outgoing()
 	p.incoming()
 }
 
+// isRunning method reports whether the exchange is still running
+func (p *Exchanger) isRunning() bool {
+	return atomic.LoadInt32(&p.running) == 1
+}
+
+// stop method stops the exchange, either direction returns once done with the packet at hand
+func (p *Exchanger) stop() {
+	atomic.StoreInt32(&p.running, 0)
+}
+
 // incoming method reads IP data from the TCP connection, decompresses it and writes it to the configured tunneling interface.
 func (p *Exchanger) incoming() {
 	// the buffer size is MTU which should be the configured MTU for the tunneling interface.
@@ -30,25 +43,33 @@ func (p *Exchanger) incoming() {
 	// pinlib exchanger uses snappy compression which gave good results in transfer speeds.
 	rd := p.conn
 
-	for p.running {
+	for p.isRunning() {
 		n, err := rd.Read(packet)
 		if err != nil {
-			if p.running {
+			if p.isRunning() {
 				fmt.Println("Incoming_Read: ", err)
 			}
 			if nc, ok := p.conn.(*NotifierConn); ok {
 				nc.Notify()
 			}
-			p.running = false
+			p.stop()
 			return
 		}
 
+		if !p.ingress.wait(n) {
+			continue
+		}
+
 		// For openbsd, there is a additional tunnel header of Address
 		// family of the packet to be added.
 		//
-		// In this case it is AF_INET (0x02)
+		// In this case it is AF_INET (0x02) or AF_INET6 (0x18)
 		if runtime.GOOS == "openbsd" {
-			packet = append([]byte{0, 0, 0, 2}, packet[:]...)
+			af := byte(2)
+			if packetVersion(packet[:n]) == 6 {
+				af = 24
+			}
+			packet = append([]byte{0, 0, 0, af}, packet[:]...)
 			n = n + 4
 		}
 		p.iface.Write(packet[:n])
@@ -63,11 +84,11 @@ func (p *Exchanger) outgoing() {
 	// snappy compressor interface
 	wr := p.conn
 
-	for p.running {
+	for p.isRunning() {
 		n, err := p.iface.Read(packet)
 		if err != nil {
 			fmt.Println("Outgoing_Read: ", err)
-			p.running = false
+			p.stop()
 			return
 		}
 
@@ -81,15 +102,19 @@ func (p *Exchanger) outgoing() {
 			}
 		}
 
+		if !p.egress.wait(n) {
+			continue
+		}
+
 		_, err = wr.Write(packet[:n])
 		if err != nil {
-			if p.running {
+			if p.isRunning() {
 				fmt.Println("Outgoing_Write: ", err)
 			}
 			if nc, ok := p.conn.(*NotifierConn); ok {
 				nc.Notify()
 			}
-			p.running = false
+			p.stop()
 			return
 		}
 	}
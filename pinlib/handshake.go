@@ -0,0 +1,236 @@
+package pinlib
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	// ErrInvalidKeyExchange is returned when the peer sends a malformed or weak X25519 public key.
+	ErrInvalidKeyExchange = errors.New("invalid key exchange")
+
+	// ErrUnknownUser is returned when a client identifies as a user the server doesn't know.
+	ErrUnknownUser = errors.New("unknown user")
+
+	// ErrUnknownPublicKey is returned when a client authenticates with a public key the server doesn't know.
+	ErrUnknownPublicKey = errors.New("unknown public key")
+)
+
+// maxUserLength is the maximum length of a user name sent during the key exchange.
+const maxUserLength = 255
+
+// SessionKeys holds the per direction ChaCha20-Poly1305 keys of a session.
+type SessionKeys struct {
+	Send, Recv [32]byte
+}
+
+// authenticator resolves the credentials a client presents during the key exchange.
+type authenticator interface {
+	// lookupSecret returns the secret of a client authenticating with a user name (empty if shared).
+	lookupSecret(user string) ([32]byte, bool)
+	// lookupPublicKey returns the user and the secret of a client authenticating with its static public key.
+	lookupPublicKey(pub [32]byte) (string, [32]byte, bool)
+}
+
+// GenerateKey generates a new X25519 key pair.
+// This is used for both the ephemeral keys of a session and the static keys of clients.
+func GenerateKey() (priv, pub [32]byte, err error) {
+	_, err = rand.Read(priv[:])
+	if err != nil {
+		return
+	}
+	pub = PublicKey(priv)
+	return
+}
+
+// PublicKey returns the X25519 public key of a private key.
+func PublicKey(priv [32]byte) [32]byte {
+	var pub [32]byte
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return pub
+}
+
+// dh computes the X25519 shared secret of a private key and a peer's public key.
+func dh(priv, pub [32]byte) ([32]byte, error) {
+	var shared, zero [32]byte
+	curve25519.ScalarMult(&shared, &priv, &pub)
+	if shared == zero {
+		return shared, ErrInvalidKeyExchange
+	}
+	return shared, nil
+}
+
+// deriveSessionKeys derives the per direction keys of a session from the X25519 shared secrets.
+// The pre shared secret is used as the HKDF salt, so a peer that doesn't know it ends up with
+// different keys and the first sealed packet fails to authenticate. The transcript binds the
+// keys to the public keys exchanged.
+func deriveSessionKeys(psk [32]byte, shared, transcript []byte, server bool) (SessionKeys, error) {
+	keys := SessionKeys{}
+
+	c2s := hkdf.New(sha256.New, shared, psk[:], append([]byte("pin client to server"), transcript...))
+	s2c := hkdf.New(sha256.New, shared, psk[:], append([]byte("pin server to client"), transcript...))
+
+	send, recv := c2s, s2c
+	if server {
+		send, recv = s2c, c2s
+	}
+
+	if _, err := io.ReadFull(send, keys.Send[:]); err != nil {
+		return keys, err
+	}
+	if _, err := io.ReadFull(recv, keys.Recv[:]); err != nil {
+		return keys, err
+	}
+
+	return keys, nil
+}
+
+// readPublicKey returns the X25519 public key held in an option of a message.
+func readPublicKey(m *message, opt byte) ([32]byte, error) {
+	var pub [32]byte
+	p, ok := m.get(opt)
+	if !ok || len(p) != len(pub) {
+		return pub, ErrInvalidKeyExchange
+	}
+	copy(pub[:], p)
+	return pub, nil
+}
+
+// clientKeyExchange sends a msgHello with the user name and an ephemeral public key to the server
+// and derives the session keys from the ephemeral public key of the msgHelloReply.
+// If the client authenticates with a static key, its public key is sent in the msgHello too.
+//
+// With a static key, the shared secret of the client's static key and the server's ephemeral key
+// is mixed into the session keys, which proves the client owns the private key.
+func clientKeyExchange(conn io.ReadWriter, user string, psk [32]byte, static *[32]byte) (SessionKeys, error) {
+	if len(user) > maxUserLength {
+		return SessionKeys{}, errors.New("user name too long")
+	}
+
+	priv, pub, err := GenerateKey()
+	if err != nil {
+		return SessionKeys{}, err
+	}
+
+	transcript := append([]byte{}, pub[:]...)
+
+	hello := newMessage(msgHello)
+	hello.set(optEphemeralKey, pub[:])
+	if user != "" {
+		hello.set(optUser, []byte(user))
+	}
+	if static != nil {
+		staticPub := PublicKey(*static)
+		hello.set(optStaticKey, staticPub[:])
+		transcript = append(transcript, staticPub[:]...)
+	}
+
+	err = writeMessage(conn, hello)
+	if err != nil {
+		return SessionKeys{}, err
+	}
+
+	reply, err := readMessage(conn, msgHelloReply)
+	if err != nil {
+		return SessionKeys{}, err
+	}
+
+	serverPub, err := readPublicKey(reply, optEphemeralKey)
+	if err != nil {
+		return SessionKeys{}, err
+	}
+
+	shared, err := dh(priv, serverPub)
+	if err != nil {
+		return SessionKeys{}, err
+	}
+
+	ikm := shared[:]
+	if static != nil {
+		ss, err := dh(*static, serverPub)
+		if err != nil {
+			return SessionKeys{}, err
+		}
+		ikm = append(ikm, ss[:]...)
+	}
+
+	return deriveSessionKeys(psk, ikm, append(transcript, serverPub[:]...), false)
+}
+
+// serverKeyExchange reads the msgHello of the client, looks up the credentials it presents,
+// replies with a msgHelloReply holding an ephemeral public key of its own and derives the
+// session keys. The authenticated user is returned along with the keys.
+func serverKeyExchange(conn io.ReadWriter, auth authenticator) (SessionKeys, string, error) {
+	hello, err := readMessage(conn, msgHello)
+	if err != nil {
+		if hello != nil && hello.version != ProtocolVersion {
+			writeMessage(conn, newErrorMessage(err.Error()))
+		}
+		return SessionKeys{}, "", err
+	}
+
+	clientPub, err := readPublicKey(hello, optEphemeralKey)
+	if err != nil {
+		return SessionKeys{}, "", err
+	}
+
+	userOpt, _ := hello.get(optUser)
+	user := string(userOpt)
+	transcript := append([]byte{}, clientPub[:]...)
+
+	var psk, staticPub [32]byte
+	_, static := hello.get(optStaticKey)
+	if static {
+		staticPub, err = readPublicKey(hello, optStaticKey)
+		if err != nil {
+			return SessionKeys{}, user, err
+		}
+		transcript = append(transcript, staticPub[:]...)
+
+		var ok bool
+		user, psk, ok = auth.lookupPublicKey(staticPub)
+		if !ok {
+			return SessionKeys{}, user, ErrUnknownPublicKey
+		}
+	} else {
+		var ok bool
+		psk, ok = auth.lookupSecret(user)
+		if !ok {
+			return SessionKeys{}, user, ErrUnknownUser
+		}
+	}
+
+	priv, pub, err := GenerateKey()
+	if err != nil {
+		return SessionKeys{}, user, err
+	}
+
+	reply := newMessage(msgHelloReply)
+	reply.set(optEphemeralKey, pub[:])
+	err = writeMessage(conn, reply)
+	if err != nil {
+		return SessionKeys{}, user, err
+	}
+
+	shared, err := dh(priv, clientPub)
+	if err != nil {
+		return SessionKeys{}, user, err
+	}
+
+	ikm := shared[:]
+	if static {
+		ss, err := dh(priv, staticPub)
+		if err != nil {
+			return SessionKeys{}, user, err
+		}
+		ikm = append(ikm, ss[:]...)
+	}
+
+	keys, err := deriveSessionKeys(psk, ikm, append(transcript, pub[:]...), true)
+	return keys, user, err
+}
@@ -0,0 +1,84 @@
+package pinlib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Keepalive specifies how a session notices a silently dead peer, say behind a NAT mapping that
+// timed out or a pulled cable. Whenever nothing was sent for Interval, an empty packet is sent.
+// Once nothing was received for Timeout, the peer is considered dead. A zero Interval disables it.
+type Keepalive struct {
+	Interval time.Duration // Interval is how long the session may go without sending
+	Timeout  time.Duration // Timeout is how long the session may go without receiving
+}
+
+// DefaultKeepalive is the Keepalive used by clients and servers which don't specify one.
+var DefaultKeepalive = Keepalive{Interval: 15 * time.Second, Timeout: time.Minute}
+
+// touch stores the current time in t
+func touch(t *int64) {
+	atomic.StoreInt64(t, time.Now().UnixNano())
+}
+
+// since returns the time passed since the time stored in t
+func since(t *int64) time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(t)))
+}
+
+// keepalive method sends the keepalives of the session and watches for the ones of the peer,
+// till the session ends. A dead peer is dealt with just like a failed connection on the client,
+// which then reconnects. The server ends the session right away instead, freeing its lease.
+func (c *resumableConn) keepalive(k Keepalive) {
+	if k.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(k.Interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		conn, lost, dead := c.conn, c.lost, c.dead
+		c.mu.Unlock()
+		if dead {
+			return
+		}
+		if lost {
+			continue
+		}
+
+		if since(&conn.lastReceived) >= k.Timeout {
+			c.deadPeer(conn)
+			continue
+		}
+
+		if since(&conn.lastSent) >= k.Interval/2 {
+			conn.Write(nil)
+		}
+	}
+}
+
+// deadPeer method handles a peer that missed its keepalives.
+func (c *resumableConn) deadPeer(conn *CryptoConn) {
+	if c.onLost != nil {
+		c.wait(conn, false)
+		return
+	}
+
+	c.mu.Lock()
+	if c.conn == conn && !c.dead {
+		c.dead = true
+		if c.lost {
+			close(c.resumed)
+		}
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
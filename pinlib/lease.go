@@ -0,0 +1,375 @@
+package pinlib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPoolExhausted is returned when there is no address left to lease.
+	ErrPoolExhausted = errors.New("no IPs available for lease")
+
+	// ErrNotInPool is returned when an address excluded or reserved is not one the pool leases.
+	ErrNotInPool = errors.New("address not in the lease pool")
+)
+
+// DefaultLeaseDuration is how long a released address stays bound to the client it was leased to.
+var DefaultLeaseDuration = time.Hour
+
+// leaseEntry is an address leased to a client
+type leaseEntry struct {
+	identity string    // authenticated user the address is leased to, empty for the shared secret
+	active   bool      // the client is connected
+	expiry   time.Time // once released, the address is bound to the identity till then
+}
+
+// leaseRecord is a lease as saved in the lease file
+type leaseRecord struct {
+	IP       string    `json:"ip"`
+	Identity string    `json:"identity"`
+	Active   bool      `json:"active,omitempty"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// addrRange is an inclusive range of IPv4 addresses
+type addrRange struct {
+	from, to uint32
+}
+
+// LeasePool allocates the IPv4 addresses of the tunnel network to the clients. The network
+// and broadcast addresses and the address of the server are never leased.
+//
+// Addresses can be excluded from the pool, or reserved for a client identity, which is then
+// always leased the same address. A released address stays bound to the identity it was
+// leased to for Duration, so a client coming back within that gets it back. Clients sharing
+// the secret have no identity, their addresses are freed as soon as released.
+//
+// Once opened with a lease file, the leases of the identities are saved to it on every change
+// and restored from it when the server starts again.
+//
+// It is safe for concurrent use.
+type LeasePool struct {
+	mu       sync.Mutex
+	gateway  uint32
+	first    uint32 // first address leased
+	last     uint32 // last address leased
+	next     uint32 // the search for a free address starts here
+	excluded []addrRange
+	reserved map[string]uint32 // static address of every identity with one
+	statics  map[uint32]string // identity every static address is reserved for
+	leases   map[uint32]*leaseEntry
+	path     string // file the leases are saved to, if any
+
+	Duration time.Duration // Duration is how long a released address stays bound to its identity
+}
+
+// NewLeasePool is used to create a new LeasePool for a network, along with the address of the server in it.
+func NewLeasePool(gw *net.IPNet) (*LeasePool, error) {
+	ip4 := gw.IP.To4()
+	ones, bits := gw.Mask.Size()
+	if ip4 == nil || bits != 32 {
+		return nil, fmt.Errorf("lease pool: %s is not an IPv4 network", gw)
+	}
+
+	network := ipToUint(ip4.Mask(gw.Mask))
+	size := uint32(1) << uint(32-ones)
+	first, last := network, network+size-1
+	if size > 2 {
+		// neither the network nor the broadcast address
+		first, last = first+1, last-1
+	}
+
+	return &LeasePool{
+		gateway:  ipToUint(ip4),
+		first:    first,
+		last:     last,
+		next:     first,
+		reserved: make(map[string]uint32),
+		statics:  make(map[uint32]string),
+		leases:   make(map[uint32]*leaseEntry),
+		Duration: DefaultLeaseDuration,
+	}, nil
+}
+
+// ipToUint returns an IPv4 address as a number
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// uintToIP returns the IPv4 address of a number
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// contains method reports whether the pool leases an address
+func (p *LeasePool) contains(n uint32) bool {
+	return n >= p.first && n <= p.last && n != p.gateway
+}
+
+// Exclude method keeps an inclusive range of addresses from being leased.
+func (p *LeasePool) Exclude(from, to net.IP) error {
+	if from.To4() == nil || to.To4() == nil {
+		return ErrNotInPool
+	}
+
+	r := addrRange{from: ipToUint(from), to: ipToUint(to)}
+	if r.from > r.to {
+		return fmt.Errorf("lease pool: empty range %s-%s", from, to)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.excluded = append(p.excluded, r)
+	return nil
+}
+
+// Reserve method reserves an address for an identity, it is leased to no other client.
+func (p *LeasePool) Reserve(identity string, ip net.IP) error {
+	if ip.To4() == nil {
+		return ErrNotInPool
+	}
+	n := ipToUint(ip)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if identity == "" {
+		return errors.New("lease pool: an address can only be reserved for a user")
+	}
+	if !p.contains(n) {
+		return ErrNotInPool
+	}
+	if other, ok := p.statics[n]; ok && other != identity {
+		return fmt.Errorf("lease pool: %s is already reserved for %q", ip, other)
+	}
+	if old, ok := p.reserved[identity]; ok {
+		delete(p.statics, old)
+	}
+
+	p.reserved[identity] = n
+	p.statics[n] = identity
+	return nil
+}
+
+// excludedAddr method reports whether an address is excluded
+func (p *LeasePool) excludedAddr(n uint32) bool {
+	for _, r := range p.excluded {
+		if n >= r.from && n <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// free method reports whether an address can be leased to a client with no claim to it.
+func (p *LeasePool) free(n uint32, now time.Time) bool {
+	return p.freeFor("", n, now)
+}
+
+// freeFor method reports whether an address can be leased to a client of the given identity.
+// Besides the free addresses, that is the address reserved for the identity or still bound to it.
+func (p *LeasePool) freeFor(identity string, n uint32, now time.Time) bool {
+	if !p.contains(n) || p.excludedAddr(n) {
+		return false
+	}
+	if other, ok := p.statics[n]; ok && (identity == "" || other != identity) {
+		return false
+	}
+	l, ok := p.leases[n]
+	if !ok {
+		return true
+	}
+	if l.active {
+		return false
+	}
+	return !now.Before(l.expiry) || (identity != "" && l.identity == identity)
+}
+
+// Allocate method leases an address to a client of the given identity. That is the address
+// reserved for it, else the preferred address if it can have it, else the one it was last
+// leased if still bound to it, else the next free one. preferred is nil if the client has
+// no preference. The address is leased till released.
+func (p *LeasePool) Allocate(identity string, preferred net.IP) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if identity != "" {
+		if n, ok := p.reserved[identity]; ok {
+			if l, ok := p.leases[n]; !ok || !l.active {
+				p.leases[n] = &leaseEntry{identity: identity, active: true}
+				p.save()
+				return uintToIP(n), nil
+			}
+			// another session of the identity holds it, this one gets an address of the pool
+		}
+	}
+
+	if preferred.To4() != nil {
+		if n := ipToUint(preferred); p.freeFor(identity, n, now) {
+			p.leases[n] = &leaseEntry{identity: identity, active: true}
+			if identity != "" {
+				p.save()
+			}
+			return uintToIP(n), nil
+		}
+	}
+
+	if identity != "" {
+		for n, l := range p.leases {
+			if l.identity == identity && !l.active && now.Before(l.expiry) {
+				l.active = true
+				p.save()
+				return uintToIP(n), nil
+			}
+		}
+	}
+
+	size := p.last - p.first + 1
+	for i := uint32(0); i < size; i++ {
+		n := p.first + (p.next-p.first+i)%size
+		if p.free(n, now) {
+			p.next = n + 1
+			if p.next > p.last {
+				p.next = p.first
+			}
+			p.leases[n] = &leaseEntry{identity: identity, active: true}
+			if identity != "" {
+				p.save()
+			}
+			return uintToIP(n), nil
+		}
+	}
+
+	return nil, ErrPoolExhausted
+}
+
+// Release method ends the lease of an address. It stays bound to its identity for Duration.
+func (p *LeasePool) Release(ip net.IP) {
+	if ip.To4() == nil {
+		return
+	}
+	n := ipToUint(ip)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.leases[n]
+	if !ok || !l.active {
+		return
+	}
+
+	if l.identity == "" {
+		delete(p.leases, n)
+		return
+	}
+	if p.Duration <= 0 {
+		delete(p.leases, n)
+	} else {
+		l.active = false
+		l.expiry = time.Now().Add(p.Duration)
+	}
+	p.save()
+}
+
+// Open method restores the leases saved to a lease file, and saves the leases to it from then on.
+// A missing file is created on the first change. Addresses leased when the file was last saved are
+// held for their identities for Duration, the clients of the previous run are bound to come back.
+// Leases which don't fit the pool anymore, say the address got excluded or reserved, are dropped.
+func (p *LeasePool) Open(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var records []leaseRecord
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && len(contents) > 0 {
+		if err := json.Unmarshal(contents, &records); err != nil {
+			return fmt.Errorf("lease file %s: %s", path, err)
+		}
+	}
+
+	now := time.Now()
+	for _, r := range records {
+		ip := net.ParseIP(r.IP)
+		if ip == nil || ip.To4() == nil || r.Identity == "" {
+			continue
+		}
+		n := ipToUint(ip)
+		if _, ok := p.reserved[r.Identity]; ok || !p.free(n, now) {
+			continue
+		}
+
+		expiry := r.Expiry
+		if r.Active {
+			expiry = now.Add(p.Duration)
+		}
+		if !now.Before(expiry) {
+			continue
+		}
+		p.leases[n] = &leaseEntry{identity: r.Identity, expiry: expiry}
+	}
+
+	p.path = path
+	return p.write()
+}
+
+// save method saves the leases to the lease file, if any. Failing to is not fatal to the
+// lease, so it is only logged.
+func (p *LeasePool) save() {
+	if err := p.write(); err != nil {
+		fmt.Println("Saving leases: ", err)
+	}
+}
+
+// write method writes the leases of the identities to the lease file. The file is replaced in
+// one go, so a crash while writing can't leave it half written.
+func (p *LeasePool) write() error {
+	if p.path == "" {
+		return nil
+	}
+
+	records := []leaseRecord{}
+	for n, l := range p.leases {
+		if l.identity == "" {
+			continue
+		}
+		records = append(records, leaseRecord{IP: uintToIP(n).String(), Identity: l.identity, Active: l.active, Expiry: l.expiry})
+	}
+
+	contents, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
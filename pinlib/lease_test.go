@@ -0,0 +1,189 @@
+package pinlib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestPool returns a pool over 10.0.0.0/29, the server being 10.0.0.1, so 10.0.0.2 to
+// 10.0.0.6 are leased.
+func newTestPool(t *testing.T) *LeasePool {
+	_, gw, err := net.ParseCIDR("10.0.0.1/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.IP = net.ParseIP("10.0.0.1")
+	pool, err := NewLeasePool(gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// allocate allocates an address and fails the test on error.
+func allocate(t *testing.T, pool *LeasePool, identity string, preferred net.IP) net.IP {
+	ip, err := pool.Allocate(identity, preferred)
+	if err != nil {
+		t.Fatalf("allocate %q: %s", identity, err)
+	}
+	return ip
+}
+
+// expectIP fails the test when an address is not the one expected.
+func expectIP(t *testing.T, got net.IP, want string) {
+	if !got.Equal(net.ParseIP(want)) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestLeasePoolExhaustion(t *testing.T) {
+	pool := newTestPool(t)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		ip := allocate(t, pool, "", nil)
+		if seen[ip.String()] {
+			t.Fatalf("%s leased twice", ip)
+		}
+		if ip.Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatal("the server address was leased")
+		}
+		seen[ip.String()] = true
+	}
+
+	if _, err := pool.Allocate("", nil); err != ErrPoolExhausted {
+		t.Fatalf("got %v, want ErrPoolExhausted", err)
+	}
+
+	pool.Release(net.ParseIP("10.0.0.4"))
+	expectIP(t, allocate(t, pool, "", nil), "10.0.0.4")
+}
+
+func TestLeasePoolWraparound(t *testing.T) {
+	pool := newTestPool(t)
+
+	for _, want := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		expectIP(t, allocate(t, pool, "", nil), want)
+	}
+	if pool.next != pool.first {
+		t.Fatalf("next is %s after the last address, want it back to the first", uintToIP(pool.next))
+	}
+
+	// the search starts over from the first address, and goes on from the one it leased
+	pool.Release(net.ParseIP("10.0.0.5"))
+	pool.Release(net.ParseIP("10.0.0.3"))
+	expectIP(t, allocate(t, pool, "", nil), "10.0.0.3")
+	expectIP(t, allocate(t, pool, "", nil), "10.0.0.5")
+}
+
+func TestLeasePoolExclusions(t *testing.T) {
+	pool := newTestPool(t)
+	if err := pool.Exclude(net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Exclude(net.ParseIP("10.0.0.6"), net.ParseIP("10.0.0.5")); err == nil {
+		t.Fatal("an empty range was excluded")
+	}
+	if err := pool.Exclude(net.ParseIP("fd00::1"), net.ParseIP("fd00::2")); err != ErrNotInPool {
+		t.Fatalf("got %v, want ErrNotInPool for IPv6", err)
+	}
+
+	// an excluded address is not leased, even when preferred
+	expectIP(t, allocate(t, pool, "alice", net.ParseIP("10.0.0.3")), "10.0.0.5")
+	expectIP(t, allocate(t, pool, "", nil), "10.0.0.6")
+	if _, err := pool.Allocate("", nil); err != ErrPoolExhausted {
+		t.Fatalf("got %v, want ErrPoolExhausted", err)
+	}
+}
+
+func TestLeasePoolStatic(t *testing.T) {
+	pool := newTestPool(t)
+	static := net.ParseIP("10.0.0.2")
+	if err := pool.Reserve("alice", static); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Reserve("bob", static); err == nil {
+		t.Fatal("an address was reserved for two identities")
+	}
+	if err := pool.Reserve("bob", net.ParseIP("10.0.1.2")); err != ErrNotInPool {
+		t.Fatalf("got %v, want ErrNotInPool", err)
+	}
+
+	// no one else gets it, asking for it or not
+	if ip := allocate(t, pool, "bob", static); ip.Equal(static) {
+		t.Fatal("the static address was leased to another identity")
+	}
+	if ip := allocate(t, pool, "", static); ip.Equal(static) {
+		t.Fatal("the static address was leased to the shared secret")
+	}
+	if ip := allocate(t, pool, "", nil); ip.Equal(static) {
+		t.Fatal("the static address was leased as a free one")
+	}
+
+	expectIP(t, allocate(t, pool, "alice", net.ParseIP("10.0.0.6")), "10.0.0.2")
+}
+
+func TestLeasePoolExpiry(t *testing.T) {
+	pool := newTestPool(t)
+
+	ip := allocate(t, pool, "alice", nil)
+	pool.Release(ip)
+
+	// still bound to alice
+	if other := allocate(t, pool, "bob", ip); other.Equal(ip) {
+		t.Fatal("an address still bound was leased to another identity")
+	}
+	expectIP(t, allocate(t, pool, "alice", nil), ip.String())
+	pool.Release(ip)
+
+	// once the binding expires it is free again
+	pool.leases[ipToUint(ip)].expiry = time.Now().Add(-time.Second)
+	expectIP(t, allocate(t, pool, "carol", ip), ip.String())
+	if other := allocate(t, pool, "alice", nil); other.Equal(ip) {
+		t.Fatal("an expired address was leased to two clients")
+	}
+}
+
+func TestLeasePoolOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+
+	pool := newTestPool(t)
+	if err := pool.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	alice := allocate(t, pool, "alice", nil)
+	bob := allocate(t, pool, "bob", nil)
+	shared := allocate(t, pool, "", nil)
+	pool.Release(bob)
+
+	restored := newTestPool(t)
+	if err := restored.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.leases[ipToUint(shared)]; ok {
+		t.Fatal("the lease of the shared secret was saved")
+	}
+
+	// both are held for their identities, connected or not when saved
+	if ip := allocate(t, restored, "carol", alice); ip.Equal(alice) || ip.Equal(bob) {
+		t.Fatalf("%s was leased to another identity", ip)
+	}
+	expectIP(t, allocate(t, restored, "bob", nil), bob.String())
+	expectIP(t, allocate(t, restored, "alice", nil), alice.String())
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestPool(t).Open(path); err == nil {
+		t.Fatal("a corrupt lease file was opened")
+	}
+}
@@ -0,0 +1,180 @@
+package pinlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the version of the handshake protocol spoken by this package.
+// It has to be bumped for every change peers of an older version can't cope with.
+// Adding an option is not such a change, as unknown options are ignored.
+const ProtocolVersion = 1
+
+// Handshake message types
+const (
+	msgHello        byte = iota + 1 // client -> server: credentials and ephemeral key, in the clear
+	msgHelloReply                   // server -> client: ephemeral key, in the clear
+	msgLeaseRequest                 // client -> server: request for an address
+	msgLeaseReply                   // server -> client: the address leased
+	msgLeaseAck                     // client -> server: the lease was accepted
+	msgError                        // either way: the handshake failed, see optError
+	msgResume                       // client -> server: request to resume a session, instead of a msgLeaseRequest
+	msgResumeReply                  // server -> client: the session was resumed
+)
+
+// Handshake message option types
+const (
+	optUser          byte = iota + 1 // user name
+	optEphemeralKey                  // X25519 ephemeral public key
+	optStaticKey                     // X25519 static public key of the client
+	optError                         // human readable reason of a msgError
+	optIPv4                          // leased IPv4 address (4 bytes) and prefix length (1 byte)
+	optGateway                       // IPv4 address of the gateway
+	optDNS                           // list of DNS server addresses pushed by the server
+	optRoutes                        // list of routes pushed by the server, each the network address and prefix length
+	optMTU                           // MTU pushed by the server, big endian 2 bytes
+	optIPv6                          // leased IPv6 address (16 bytes) and prefix length (1 byte)
+	optGateway6                      // IPv6 address of the gateway
+	optSessionToken                  // token the session can be resumed with, issued in the msgLeaseReply
+	optRequestedIPv4                 // IPv4 address the client asks to be leased, in the msgLeaseRequest
+	optSubnets                       // list of subnets behind the client, as advertised, and as accepted in the msgLeaseReply
+)
+
+var (
+	// ErrUnsupportedVersion is returned when the peer speaks a handshake protocol version this package doesn't.
+	ErrUnsupportedVersion = errors.New("unsupported handshake protocol version")
+
+	// ErrInvalidMessage is returned when a handshake message is malformed or not the one expected.
+	ErrInvalidMessage = errors.New("invalid handshake message")
+)
+
+// message is a handshake message. On the wire it is the protocol version, the message type
+// and a sequence of options, each made of its type, its big endian 2 byte length and its value.
+type message struct {
+	version byte
+	typ     byte
+	options map[byte][]byte
+}
+
+// newMessage is used to create a new message of the current protocol version
+func newMessage(typ byte) *message {
+	return &message{version: ProtocolVersion, typ: typ, options: make(map[byte][]byte)}
+}
+
+// newErrorMessage is used to create a msgError message with the reason of the failure
+func newErrorMessage(reason string) *message {
+	m := newMessage(msgError)
+	m.set(optError, []byte(reason))
+	return m
+}
+
+// set method sets the value of an option.
+func (m *message) set(opt byte, value []byte) {
+	m.options[opt] = value
+}
+
+// get method returns the value of an option and whether it is present.
+func (m *message) get(opt byte) ([]byte, bool) {
+	v, ok := m.options[opt]
+	return v, ok
+}
+
+// marshal method returns the wire format of the message.
+func (m *message) marshal() []byte {
+	p := []byte{m.version, m.typ}
+	for opt, value := range m.options {
+		hdr := []byte{opt, 0, 0}
+		binary.BigEndian.PutUint16(hdr[1:], uint16(len(value)))
+		p = append(p, hdr...)
+		p = append(p, value...)
+	}
+	return p
+}
+
+// parseMessage parses the wire format of a message. Options of an unknown type are kept
+// and simply never looked up. Messages of an unknown protocol version are not parsed further.
+func parseMessage(p []byte) (*message, error) {
+	if len(p) < 2 {
+		return nil, ErrInvalidMessage
+	}
+
+	m := &message{version: p[0], typ: p[1], options: make(map[byte][]byte)}
+	if m.version != ProtocolVersion {
+		return m, fmt.Errorf("%w: peer speaks version %d, expected %d", ErrUnsupportedVersion, m.version, ProtocolVersion)
+	}
+
+	p = p[2:]
+	for len(p) > 0 {
+		if len(p) < 3 {
+			return nil, ErrInvalidMessage
+		}
+		n := int(binary.BigEndian.Uint16(p[1:3]))
+		if len(p) < 3+n {
+			return nil, ErrInvalidMessage
+		}
+		m.options[p[0]] = p[3 : 3+n]
+		p = p[3+n:]
+	}
+
+	return m, nil
+}
+
+// encodeList joins a list of values into a single option value, each prefixed with its 1 byte length.
+func encodeList(values [][]byte) []byte {
+	p := []byte{}
+	for _, v := range values {
+		p = append(p, byte(len(v)))
+		p = append(p, v...)
+	}
+	return p
+}
+
+// decodeList splits an option value encoded with encodeList.
+func decodeList(p []byte) ([][]byte, error) {
+	values := [][]byte{}
+	for len(p) > 0 {
+		n := int(p[0])
+		if len(p) < 1+n {
+			return nil, ErrInvalidMessage
+		}
+		values = append(values, p[1:1+n])
+		p = p[1+n:]
+	}
+	return values, nil
+}
+
+// writeMessage writes a message as a single record.
+func writeMessage(conn io.Writer, m *message) error {
+	_, err := conn.Write(m.marshal())
+	return err
+}
+
+// readMessage reads a single record holding a message of one of the given types.
+// If the peer sent a msgError instead, its reason is returned as the error.
+func readMessage(conn io.Reader, types ...byte) (*message, error) {
+	p := make([]byte, MaxRecordSize())
+	n, err := conn.Read(p)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := parseMessage(p[:n])
+	if err != nil {
+		return m, err
+	}
+
+	if m.typ == msgError {
+		reason, _ := m.get(optError)
+		return m, fmt.Errorf("peer: %s", reason)
+	}
+
+	for _, typ := range types {
+		if m.typ == typ {
+			return m, nil
+		}
+	}
+
+	return m, ErrInvalidMessage
+}
@@ -1,22 +1,47 @@
 package pinlib
 
 import (
-	"math/rand"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
 )
 
-// Rng is a struct used to generate a random number generator from an initial seed
-type Rng struct {
-	rand *rand.Rand
+var (
+	// ErrNonceExhausted is returned when a NonceGenerator has handed out every possible nonce.
+	ErrNonceExhausted = errors.New("nonce space exhausted")
+)
+
+// NonceGenerator hands out monotonically increasing sequence numbers along with the
+// 12 byte nonces derived from them. As every session direction is sealed with a key
+// of its own, a counter starting at zero never repeats a nonce for a key.
+type NonceGenerator struct {
+	mu      sync.Mutex
+	counter uint64
+}
+
+// NewNonceGenerator is used to create a new NonceGenerator struct
+func NewNonceGenerator() *NonceGenerator {
+	return &NonceGenerator{}
 }
 
-// NewRng is used to create a new Rng struct
-func NewRng(seed int64) *Rng {
-	return &Rng{rand: rand.New(rand.NewSource(seed))}
+// Next method returns the next sequence number and its nonce.
+func (ng *NonceGenerator) Next() (uint64, [12]byte, error) {
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+
+	if ng.counter == math.MaxUint64 {
+		return 0, [12]byte{}, ErrNonceExhausted
+	}
+
+	seq := ng.counter
+	ng.counter++
+	return seq, sequenceNonce(seq), nil
 }
 
-// RandomNonceGenerator method is used to generate a 12 byte random nonce.
-func (rng *Rng) RandomNonceGenerator() [12]byte {
-	var p = [12]byte{0}
-	rng.rand.Read(p[:])
-	return p
+// sequenceNonce returns the nonce used to seal the packet with the given sequence number.
+func sequenceNonce(seq uint64) [12]byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
 }
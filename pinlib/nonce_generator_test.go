@@ -0,0 +1,99 @@
+package pinlib
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// sharedSecret authenticates every client with the same secret, as clients sharing the secret do.
+type sharedSecret [32]byte
+
+func (s sharedSecret) lookupSecret(user string) ([32]byte, bool) { return s, user == "" }
+
+func (s sharedSecret) lookupPublicKey(pub [32]byte) (string, [32]byte, bool) {
+	return "", s, false
+}
+
+// exchangeKeys runs the key exchange of a new session and returns the keys of both ends.
+func exchangeKeys(t *testing.T, secret sharedSecret) (client, server SessionKeys) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, _, err = serverKeyExchange(NewRecordConn(s), secret)
+		done <- err
+	}()
+
+	client, err := clientKeyExchange(NewRecordConn(c), "", secret, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	return client, server
+}
+
+// TestNonceUniqueAcrossSessions seals with every direction of many sessions sharing the same
+// secret at once, with several goroutines per direction, and checks that no key and nonce pair
+// is ever handed out twice.
+func TestNonceUniqueAcrossSessions(t *testing.T) {
+	const sessions, writers, nonces = 32, 4, 500
+
+	type keyNonce struct {
+		key   [32]byte
+		nonce [12]byte
+	}
+	var mu sync.Mutex
+	seen := make(map[keyNonce]bool)
+
+	secret := sharedSecret{1, 2, 3}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, server := exchangeKeys(t, secret)
+			if client.Send != server.Recv || client.Recv != server.Send {
+				t.Error("the ends derived different keys")
+				return
+			}
+
+			sealers := &sync.WaitGroup{}
+			for _, key := range [][32]byte{client.Send, server.Send} {
+				ng := NewNonceGenerator()
+				for w := 0; w < writers; w++ {
+					sealers.Add(1)
+					go func(key [32]byte) {
+						defer sealers.Done()
+						for n := 0; n < nonces; n++ {
+							_, nonce, err := ng.Next()
+							if err != nil {
+								t.Error(err)
+								return
+							}
+
+							kn := keyNonce{key: key, nonce: nonce}
+							mu.Lock()
+							if seen[kn] {
+								t.Errorf("nonce %x repeated for a key", nonce)
+							}
+							seen[kn] = true
+							mu.Unlock()
+						}
+					}(key)
+				}
+			}
+			sealers.Wait()
+		}()
+	}
+	wg.Wait()
+
+	if want := sessions * 2 * writers * nonces; len(seen) != want {
+		t.Fatalf("got %d key and nonce pairs, want %d", len(seen), want)
+	}
+}
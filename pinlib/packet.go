@@ -0,0 +1,97 @@
+package pinlib
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// packetVersion returns the IP version of a packet read from or written to a tunneling interface.
+func packetVersion(p []byte) int {
+	if len(p) == 0 {
+		return 0
+	}
+	return int(p[0] >> 4)
+}
+
+// packetDestination returns the destination address of an IPv4 or IPv6 packet.
+// The address is a slice of the packet itself.
+func packetDestination(p []byte) (net.IP, bool) {
+	switch packetVersion(p) {
+	case 4:
+		if len(p) < 20 {
+			return nil, false
+		}
+		return net.IP(p[16:20]), true
+	case 6:
+		if len(p) < 40 {
+			return nil, false
+		}
+		return net.IP(p[24:40]), true
+	}
+	return nil, false
+}
+
+// packetSource returns the source address of an IPv4 or IPv6 packet.
+// The address is a slice of the packet itself.
+func packetSource(p []byte) (net.IP, bool) {
+	switch packetVersion(p) {
+	case 4:
+		if len(p) < 20 {
+			return nil, false
+		}
+		return net.IP(p[12:16]), true
+	case 6:
+		if len(p) < 40 {
+			return nil, false
+		}
+		return net.IP(p[8:24]), true
+	}
+	return nil, false
+}
+
+// Transport protocols the ports of a packet are known for
+const (
+	protoTCP  = 6
+	protoUDP  = 17
+	protoSCTP = 132
+)
+
+// packetPorts returns the transport protocol of an IPv4 or IPv6 packet along with its source
+// and destination ports. The ports are only known for the first fragment of TCP, UDP and SCTP
+// packets, and IPv6 packets without extension headers, hasPorts is false otherwise.
+// Neither is known for a packet with a malformed header, proto is 0 then.
+func packetPorts(p []byte) (proto byte, src, dst uint16, hasPorts bool) {
+	var offset int
+	switch packetVersion(p) {
+	case 4:
+		if len(p) < 20 {
+			return 0, 0, 0, false
+		}
+		offset = int(p[0]&0x0f) * 4
+		if offset < 20 {
+			// the header length can't be shorter than the fixed header
+			return 0, 0, 0, false
+		}
+		proto = p[9]
+		if binary.BigEndian.Uint16(p[6:8])&0x1fff != 0 {
+			// not the first fragment
+			return proto, 0, 0, false
+		}
+	case 6:
+		if len(p) < 40 {
+			return 0, 0, 0, false
+		}
+		proto = p[6]
+		offset = 40
+	default:
+		return 0, 0, 0, false
+	}
+
+	if proto != protoTCP && proto != protoUDP && proto != protoSCTP {
+		return proto, 0, 0, false
+	}
+	if len(p) < offset+4 {
+		return proto, 0, 0, false
+	}
+	return proto, binary.BigEndian.Uint16(p[offset : offset+2]), binary.BigEndian.Uint16(p[offset+2 : offset+4]), true
+}
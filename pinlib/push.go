@@ -0,0 +1,104 @@
+package pinlib
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// PushConfig holds the settings a server pushes to every client during the handshake,
+// so that the behaviour of the clients can be managed centrally.
+type PushConfig struct {
+	DNS    []net.IP     // DNS servers the clients should use
+	Routes []*net.IPNet // networks to route through the tunnel, 0.0.0.0/0 for a full tunnel
+	MTU    int          // MTU of the tunneling interface, 0 to leave it to the client
+}
+
+// set method adds the pushed settings as options of a handshake message.
+func (pc *PushConfig) set(m *message) {
+	if len(pc.DNS) > 0 {
+		values := [][]byte{}
+		for _, ip := range pc.DNS {
+			values = append(values, normalizeIP(ip))
+		}
+		m.set(optDNS, encodeList(values))
+	}
+
+	if len(pc.Routes) > 0 {
+		m.set(optRoutes, encodeNets(pc.Routes))
+	}
+
+	if pc.MTU > 0 {
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, uint16(pc.MTU))
+		m.set(optMTU, mtu)
+	}
+}
+
+// get method reads the pushed settings from the options of a handshake message.
+func (pc *PushConfig) get(m *message) error {
+	if p, ok := m.get(optDNS); ok {
+		values, err := decodeList(p)
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			if len(v) != net.IPv4len && len(v) != net.IPv6len {
+				return ErrInvalidMessage
+			}
+			pc.DNS = append(pc.DNS, net.IP(v))
+		}
+	}
+
+	if p, ok := m.get(optRoutes); ok {
+		routes, err := decodeNets(p)
+		if err != nil {
+			return err
+		}
+		pc.Routes = routes
+	}
+
+	if p, ok := m.get(optMTU); ok {
+		if len(p) != 2 {
+			return ErrInvalidMessage
+		}
+		pc.MTU = int(binary.BigEndian.Uint16(p))
+	}
+
+	return nil
+}
+
+// encodeNets encodes a list of networks as an option value, each the network address and prefix length.
+func encodeNets(nets []*net.IPNet) []byte {
+	values := [][]byte{}
+	for _, n := range nets {
+		prefix, _ := n.Mask.Size()
+		values = append(values, append(normalizeIP(n.IP.Mask(n.Mask)), byte(prefix)))
+	}
+	return encodeList(values)
+}
+
+// decodeNets decodes a list of networks encoded by encodeNets.
+func decodeNets(p []byte) ([]*net.IPNet, error) {
+	values, err := decodeList(p)
+	if err != nil {
+		return nil, err
+	}
+
+	nets := []*net.IPNet{}
+	for _, v := range values {
+		n := len(v) - 1
+		if (n != net.IPv4len && n != net.IPv6len) || int(v[n]) > n*8 {
+			return nil, ErrInvalidMessage
+		}
+		nets = append(nets, &net.IPNet{IP: net.IP(v[:n]), Mask: net.CIDRMask(int(v[n]), n*8)})
+	}
+	return nets, nil
+}
+
+// normalizeIP returns the 4 byte form of IPv4 addresses and the 16 byte form of IPv6 addresses.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
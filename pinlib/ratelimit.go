@@ -0,0 +1,142 @@
+package pinlib
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientQueueSize is the number of packets queued for a client on the server
+const clientQueueSize = 256
+
+// RateLimit specifies the bandwidth a client is allowed in both directions. The packets beyond
+// the rate are delayed till the client is within the rate again, or dropped if that takes longer
+// than MaxDelay. Burst bytes can be sent at once after the client was idle. The packets to a
+// client wait in a queue of its own while delayed, so the other clients are not held up.
+type RateLimit struct {
+	In       uint64        // In is the rate in bytes per second of the packets from the client, 0 for no limit
+	Out      uint64        // Out is the rate in bytes per second of the packets to the client, 0 for no limit
+	Burst    uint64        // Burst is the size of the burst in bytes, if 0 a tenth of a second at the rate
+	MaxDelay time.Duration // MaxDelay is how long a packet can be delayed, 0 to drop the packets beyond the rate
+}
+
+// ShapingStat holds the number of bytes of the packets delayed or dropped by the rate limits.
+type ShapingStat struct {
+	DelayedIn  uint64 // bytes from the clients delayed
+	DroppedIn  uint64 // bytes from the clients dropped
+	DelayedOut uint64 // bytes to the clients delayed
+	DroppedOut uint64 // bytes to the clients dropped
+}
+
+// tokenBucket limits the rate of the packets in one direction of an Exchanger. It is only
+// used by the goroutine exchanging the packets in that direction, so it is not locked.
+type tokenBucket struct {
+	rate     float64 // bytes per second
+	burst    float64 // bytes
+	maxDelay time.Duration
+	tokens   float64 // bytes that can be sent right away, negative while paying back a delay
+	last     time.Time
+
+	delayed *uint64 // counter of the bytes delayed
+	dropped *uint64 // counter of the bytes dropped
+}
+
+// newTokenBucket is used to create a new tokenBucket for the given rate in bytes per second,
+// which counts the bytes it delays and drops. It is nil, letting everything through, for a 0 rate.
+func newTokenBucket(rate, burst uint64, maxDelay time.Duration, delayed, dropped *uint64) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = rate / 10
+	}
+	// a packet larger than the bucket would always be delayed
+	if burst < uint64(MTU) {
+		burst = uint64(MTU)
+	}
+
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), maxDelay: maxDelay, tokens: float64(burst), last: time.Now(), delayed: delayed, dropped: dropped}
+}
+
+// wait method takes the tokens for a packet of n bytes, waiting for them if need be. It reports
+// whether the packet is to be sent, false if it is dropped as it would have to wait too long.
+func (b *tokenBucket) wait(n int) bool {
+	if b == nil {
+		return true
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	size := float64(n)
+	if b.tokens >= size {
+		b.tokens -= size
+		return true
+	}
+
+	delay := time.Duration((size - b.tokens) / b.rate * float64(time.Second))
+	if delay > b.maxDelay {
+		atomic.AddUint64(b.dropped, uint64(n))
+		return false
+	}
+
+	// the tokens are paid back while waiting
+	b.tokens -= size
+	atomic.AddUint64(b.delayed, uint64(n))
+	time.Sleep(delay)
+	return true
+}
+
+// packetQueue is a bounded queue of the packets to a client on the server. The packets are
+// routed to it by the mux, which never waits on a client: a packet not fitting in the queue is
+// dropped, so a client being delayed or slow to send to doesn't hold up the packets to the others.
+type packetQueue struct {
+	packets chan []byte
+	closed  chan struct{}
+	once    sync.Once
+	dropped *uint64 // counter of the bytes dropped
+}
+
+// newPacketQueue is used to create a new packetQueue of size packets, which counts the bytes it drops.
+func newPacketQueue(size int, dropped *uint64) *packetQueue {
+	return &packetQueue{packets: make(chan []byte, size), closed: make(chan struct{}), dropped: dropped}
+}
+
+// Write method implements io.Writer interface for the packetQueue. A packet is queued whole,
+// or dropped if the queue is full.
+func (q *packetQueue) Write(p []byte) (int, error) {
+	select {
+	case <-q.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	select {
+	case q.packets <- append([]byte{}, p...):
+	default:
+		atomic.AddUint64(q.dropped, uint64(len(p)))
+	}
+	return len(p), nil
+}
+
+// Read method implements io.Reader interface for the packetQueue. Every Read returns one packet,
+// waiting for one if the queue is empty, and io.EOF once the queue is closed.
+func (q *packetQueue) Read(p []byte) (int, error) {
+	select {
+	case packet := <-q.packets:
+		return copy(p, packet), nil
+	case <-q.closed:
+		return 0, io.EOF
+	}
+}
+
+// Close method implements io.Closer interface for the packetQueue.
+func (q *packetQueue) Close() error {
+	q.once.Do(func() { close(q.closed) })
+	return nil
+}
@@ -0,0 +1,63 @@
+package pinlib
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPacketQueueDrops(t *testing.T) {
+	var dropped uint64
+	q := newPacketQueue(2, &dropped)
+
+	// nothing reads the queue, the writes must not wait for it
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			q.Write([]byte{byte(i), 0, 0})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writing to a full queue blocked")
+	}
+	if dropped != 9 {
+		t.Fatalf("%d bytes dropped, want the 9 not fitting", dropped)
+	}
+
+	p := make([]byte, MTU)
+	for want := byte(0); want < 2; want++ {
+		n, err := q.Read(p)
+		if err != nil || n != 3 || p[0] != want {
+			t.Fatalf("read %v %v, want packet %d", p[:n], err, want)
+		}
+	}
+
+	q.Close()
+	if _, err := q.Read(p); err != io.EOF {
+		t.Fatalf("got %v reading a closed queue, want io.EOF", err)
+	}
+	if _, err := q.Write(p[:3]); err != io.ErrClosedPipe {
+		t.Fatalf("got %v writing to a closed queue, want io.ErrClosedPipe", err)
+	}
+}
+
+func TestTokenBucketDrops(t *testing.T) {
+	var delayed, dropped uint64
+	b := newTokenBucket(uint64(MTU), 0, 0, &delayed, &dropped)
+
+	if !b.wait(MTU) {
+		t.Fatal("the burst was not let through")
+	}
+	if b.wait(MTU) {
+		t.Fatal("a packet beyond the rate was let through with no MaxDelay")
+	}
+	if delayed != 0 || dropped != uint64(MTU) {
+		t.Fatalf("delayed %d and dropped %d bytes, want %d dropped", delayed, dropped, MTU)
+	}
+	if newTokenBucket(0, 0, 0, &delayed, &dropped) != nil {
+		t.Fatal("a bucket was made for no limit")
+	}
+}
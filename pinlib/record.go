@@ -0,0 +1,94 @@
+package pinlib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// recordHeaderSize is the size of the big endian length prefix of every record.
+	recordHeaderSize = 2
+
+	// cryptoHeaderSize is the size of the key epoch and sequence number CryptoConn prefixes every sealed packet with.
+	cryptoHeaderSize = 1 + 8
+
+	// sealOverhead is the number of bytes CryptoConn adds to every sealed packet (header + Poly1305 tag).
+	sealOverhead = cryptoHeaderSize + 16
+)
+
+var (
+	// ErrRecordTooLarge is returned when a record is larger than MaxRecordSize.
+	// When read, this means the stream is corrupt and the connection should be dropped.
+	ErrRecordTooLarge = errors.New("record too large")
+)
+
+// MaxRecordSize returns the largest record body a RecordConn will send or accept.
+// This is a sealed packet of MTU bytes.
+func MaxRecordSize() int {
+	return MTU + sealOverhead
+}
+
+// RecordConn is a net.Conn wrapper that frames every Write as a single length prefixed record.
+// Every Read returns exactly one record irrespective of how the underlying stream
+// split or coalesced the written bytes.
+type RecordConn struct {
+	net.Conn
+	rd  *bufio.Reader
+	hdr [recordHeaderSize]byte
+	wmu sync.Mutex
+}
+
+// NewRecordConn is used to create a new RecordConn struct
+func NewRecordConn(conn net.Conn) *RecordConn {
+	return &RecordConn{Conn: conn, rd: bufio.NewReaderSize(conn, recordHeaderSize+MaxRecordSize())}
+}
+
+// Read method implements io.Reader interface for the RecordConn.
+// A whole record is read into p. If p is too small to hold the record, the record
+// is discarded and io.ErrShortBuffer is returned.
+func (rc *RecordConn) Read(p []byte) (int, error) {
+	_, err := io.ReadFull(rc.rd, rc.hdr[:])
+	if err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(rc.hdr[:]))
+	if n > MaxRecordSize() {
+		return 0, ErrRecordTooLarge
+	}
+
+	if n > len(p) {
+		_, err = rc.rd.Discard(n)
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+
+	return io.ReadFull(rc.rd, p[:n])
+}
+
+// Write method implements io.Writer interface for the RecordConn.
+// p is sent as a single record.
+func (rc *RecordConn) Write(p []byte) (int, error) {
+	if len(p) > MaxRecordSize() {
+		return 0, ErrRecordTooLarge
+	}
+
+	out := make([]byte, recordHeaderSize+len(p))
+	binary.BigEndian.PutUint16(out, uint16(len(p)))
+	copy(out[recordHeaderSize:], p)
+
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+
+	_, err := rc.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
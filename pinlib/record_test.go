@@ -0,0 +1,116 @@
+package pinlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// streamConn is a net.Conn reading from a byte stream in chunks of at most chunk bytes,
+// and writing to a buffer. A chunk of 0 reads random chunk sizes from 1 to 7 bytes.
+type streamConn struct {
+	net.Conn
+	r     *bytes.Reader
+	w     bytes.Buffer
+	chunk int
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n := c.chunk
+	if n == 0 {
+		n = rand.Intn(7) + 1
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	return c.r.Read(p[:n])
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// writeRecords returns the stream of the given records as written by a RecordConn.
+func writeRecords(t *testing.T, records [][]byte) []byte {
+	c := &streamConn{}
+	rc := NewRecordConn(c)
+	for _, r := range records {
+		n, err := rc.Write(r)
+		if err != nil || n != len(r) {
+			t.Fatalf("Write: %d, %v", n, err)
+		}
+	}
+	return c.w.Bytes()
+}
+
+// randomRecords returns count records of random sizes up to MaxRecordSize.
+func randomRecords(count int) [][]byte {
+	records := make([][]byte, count)
+	for i := range records {
+		records[i] = make([]byte, rand.Intn(MaxRecordSize()+1))
+		rand.Read(records[i])
+	}
+	return records
+}
+
+// readRecords reads the records back from a stream read in chunks of chunk bytes.
+func readRecords(t *testing.T, stream []byte, chunk int, records [][]byte) {
+	rc := NewRecordConn(&streamConn{r: bytes.NewReader(stream), chunk: chunk})
+	p := make([]byte, MaxRecordSize())
+	for i, r := range records {
+		n, err := rc.Read(p)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !bytes.Equal(p[:n], r) {
+			t.Fatalf("record %d: got %d bytes, want %d", i, n, len(r))
+		}
+	}
+	if _, err := rc.Read(p); err != io.EOF {
+		t.Fatalf("after the last record: got %v, want io.EOF", err)
+	}
+}
+
+func TestRecordConnSplitReads(t *testing.T) {
+	records := randomRecords(200)
+	readRecords(t, writeRecords(t, records), 0, records)
+}
+
+func TestRecordConnCoalescedReads(t *testing.T) {
+	records := randomRecords(200)
+	stream := writeRecords(t, records)
+	readRecords(t, stream, len(stream), records)
+}
+
+func TestRecordConnTooLarge(t *testing.T) {
+	rc := NewRecordConn(&streamConn{})
+	if _, err := rc.Write(make([]byte, MaxRecordSize()+1)); err != ErrRecordTooLarge {
+		t.Fatalf("Write: got %v, want ErrRecordTooLarge", err)
+	}
+
+	stream := make([]byte, recordHeaderSize+MaxRecordSize()+1)
+	binary.BigEndian.PutUint16(stream, uint16(MaxRecordSize()+1))
+	rc = NewRecordConn(&streamConn{r: bytes.NewReader(stream)})
+	if _, err := rc.Read(make([]byte, len(stream))); err != ErrRecordTooLarge {
+		t.Fatalf("Read: got %v, want ErrRecordTooLarge", err)
+	}
+}
+
+func TestRecordConnShortBuffer(t *testing.T) {
+	records := [][]byte{bytes.Repeat([]byte{1}, 100), []byte("next")}
+	rc := NewRecordConn(&streamConn{r: bytes.NewReader(writeRecords(t, records))})
+
+	if _, err := rc.Read(make([]byte, 99)); err != io.ErrShortBuffer {
+		t.Fatalf("got %v, want io.ErrShortBuffer", err)
+	}
+
+	// the record too large for the buffer is discarded, the next one is read whole
+	p := make([]byte, 100)
+	n, err := rc.Read(p)
+	if err != nil || string(p[:n]) != "next" {
+		t.Fatalf("got %q, %v, want the next record", p[:n], err)
+	}
+}
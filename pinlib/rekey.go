@@ -0,0 +1,51 @@
+package pinlib
+
+import (
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// RekeyPolicy specifies when a CryptoConn moves on to the key of the next epoch.
+// Rekeying happens in band, the TCP connection is not torn down for it.
+type RekeyPolicy struct {
+	Interval time.Duration // rekey after this much time has passed in an epoch, 0 disables it
+	Bytes    uint64        // rekey after this many bytes are sealed in an epoch, 0 disables it
+	Grace    time.Duration // how long the key of the previous epoch is still accepted
+}
+
+const (
+	// maxEpochSkip is how many epochs ahead of the current one a packet may be sealed in.
+	// Over datagram transports every packet of an epoch may be lost, the receiving side
+	// then moves on to the epoch of the next packet authenticated.
+	maxEpochSkip = 8
+
+	// MinRekeyInterval and MinRekeyBytes bound how short an epoch may be configured, so that
+	// a burst of lost packets doesn't span more than maxEpochSkip epochs.
+	MinRekeyInterval = 10 * time.Second
+	MinRekeyBytes    = 1 << 20
+)
+
+var (
+	// DefaultRekeyPolicy is used by clients and servers unless configured otherwise.
+	DefaultRekeyPolicy = RekeyPolicy{Interval: 10 * time.Minute, Bytes: 1 << 30, Grace: 30 * time.Second}
+)
+
+// due method reports whether an epoch that started at start and has sealed n bytes should end.
+func (rp RekeyPolicy) due(start time.Time, n uint64) bool {
+	if rp.Interval > 0 && time.Since(start) >= rp.Interval {
+		return true
+	}
+	return rp.Bytes > 0 && n >= rp.Bytes
+}
+
+// nextKey derives the key of the next epoch from the key of the current one.
+// Both the peers ratchet their keys the same way, so no key material is exchanged
+// and the keys of past epochs can't be recovered from the current one.
+func nextKey(key [32]byte) ([32]byte, error) {
+	var next [32]byte
+	_, err := io.ReadFull(hkdf.New(sha256.New, key[:], nil, []byte("pin rekey")), next[:])
+	return next, err
+}
@@ -0,0 +1,117 @@
+package pinlib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// recordSink is a connection keeping every record written to it, for them to be delivered
+// in any order, or not at all.
+type recordSink struct {
+	net.Conn
+	records [][]byte
+}
+
+func (s *recordSink) Write(p []byte) (int, error) {
+	s.records = append(s.records, append([]byte(nil), p[recordHeaderSize:]...))
+	return len(p), nil
+}
+
+// sealEpochs returns packets sealed by a CryptoConn rekeying after every packet, so that
+// the nth packet is sealed in epoch n, and a CryptoConn to open them with.
+func sealEpochs(t *testing.T, n int, grace time.Duration) ([][]byte, *CryptoConn) {
+	policy := RekeyPolicy{Bytes: 1, Grace: grace}
+	sink := &recordSink{}
+	sender, err := NewCryptoConn(NewRecordConn(sink), SessionKeys{}, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := sender.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, _ := net.Pipe()
+	receiver, err := NewCryptoConn(NewRecordConn(c), SessionKeys{}, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink.records, receiver
+}
+
+// expectOpen fails the test when the nth packet doesn't open, or opens to the wrong payload.
+// The packet is opened in a copy, so it can be delivered again.
+func expectOpen(t *testing.T, conn *CryptoConn, packets [][]byte, n int) {
+	x, _, err := conn.open(append([]byte(nil), packets[n]...))
+	if err != nil {
+		t.Fatalf("packet of epoch %d: %s", n, err)
+	}
+	if len(x) != 1 || x[0] != byte(n) {
+		t.Fatalf("packet of epoch %d opened to %v", n, x)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	packets, receiver := sealEpochs(t, 300, time.Minute)
+	for n := range packets {
+		expectOpen(t, receiver, packets, n)
+	}
+	// the epoch wraps around past 255
+	if want := uint8(len(packets) - 1); receiver.recvEpoch != want {
+		t.Fatalf("the receiving side is in epoch %d, want %d", receiver.recvEpoch, want)
+	}
+}
+
+// TestRekeyLostEpochs checks the receiving side catches up with the sending side when every
+// packet of a few epochs is lost, and gives up on a packet too far ahead.
+func TestRekeyLostEpochs(t *testing.T) {
+	packets, receiver := sealEpochs(t, 2*maxEpochSkip+3, time.Minute)
+
+	expectOpen(t, receiver, packets, 0)
+	expectOpen(t, receiver, packets, maxEpochSkip)
+
+	// packets of the epochs skipped are stale, the one of the epoch left is still in its grace period
+	expectOpen(t, receiver, packets, 0)
+	if _, _, err := receiver.open(packets[1]); err != errStaleEpoch {
+		t.Fatalf("got %v for a packet of an epoch skipped, want errStaleEpoch", err)
+	}
+
+	expectOpen(t, receiver, packets, maxEpochSkip+1)
+	if _, _, err := receiver.open(packets[2*maxEpochSkip+2]); err == nil {
+		t.Fatal("a packet more than maxEpochSkip epochs ahead was opened")
+	}
+	expectOpen(t, receiver, packets, 2*maxEpochSkip+1)
+}
+
+// TestRekeyForgedEpoch checks a packet of an epoch ahead that fails to authenticate doesn't
+// move the receiving side.
+func TestRekeyForgedEpoch(t *testing.T) {
+	packets, receiver := sealEpochs(t, 3, time.Minute)
+	expectOpen(t, receiver, packets, 0)
+
+	forged := append([]byte(nil), packets[2]...)
+	forged[len(forged)-1] ^= 1
+	if _, _, err := receiver.open(forged); err == nil {
+		t.Fatal("a forged packet was opened")
+	}
+	if receiver.recvEpoch != 0 {
+		t.Fatalf("a forged packet moved the receiving side to epoch %d", receiver.recvEpoch)
+	}
+	expectOpen(t, receiver, packets, 1)
+	expectOpen(t, receiver, packets, 2)
+}
+
+func TestRekeyGrace(t *testing.T) {
+	packets, receiver := sealEpochs(t, 2, time.Minute)
+	expectOpen(t, receiver, packets, 1)
+
+	// a packet of the previous epoch delayed past the switch
+	expectOpen(t, receiver, packets, 0)
+
+	receiver.previousExpiry = time.Now().Add(-time.Second)
+	if _, _, err := receiver.open(packets[0]); err != errStaleEpoch {
+		t.Fatalf("got %v once the grace period is over, want errStaleEpoch", err)
+	}
+}
@@ -0,0 +1,44 @@
+package pinlib
+
+const (
+	replayWindowWords = 16
+
+	// replayWindowSize is the number of sequence numbers behind the highest one received
+	// that are still accepted if they haven't been seen yet.
+	replayWindowSize = (replayWindowWords - 1) * 64
+)
+
+// replayWindow is a sliding window over the sequence numbers received (RFC 6479).
+// The window is a ring of bitmap words, a bit set for every sequence number seen.
+type replayWindow struct {
+	last   uint64
+	bitmap [replayWindowWords]uint64
+}
+
+// accept method reports whether seq is new and inside the window, and marks it as seen.
+// This should only be called for packets that were successfully authenticated.
+func (w *replayWindow) accept(seq uint64) bool {
+	index := seq >> 6
+
+	if seq > w.last {
+		current := w.last >> 6
+		diff := index - current
+		if diff > replayWindowWords {
+			diff = replayWindowWords
+		}
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(current+i)%replayWindowWords] = 0
+		}
+		w.last = seq
+	} else if w.last-seq >= replayWindowSize {
+		return false
+	}
+
+	word := &w.bitmap[index%replayWindowWords]
+	bit := uint64(1) << (seq & 63)
+	if *word&bit != 0 {
+		return false
+	}
+	*word |= bit
+	return true
+}
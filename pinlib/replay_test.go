@@ -0,0 +1,45 @@
+package pinlib
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		seqs []uint64
+		want []bool
+	}{
+		{"in order", []uint64{0, 1, 2, 3}, []bool{true, true, true, true}},
+		{"duplicate", []uint64{0, 1, 1, 0}, []bool{true, true, false, false}},
+		{"reordered", []uint64{5, 3, 4, 0, 4}, []bool{true, true, true, true, false}},
+		{"reordered across words", []uint64{200, 63, 64, 130, 63}, []bool{true, true, true, true, false}},
+		{"oldest in the window", []uint64{replayWindowSize, 1, 1}, []bool{true, true, false}},
+		{"too old", []uint64{replayWindowSize + 10, 11, 10}, []bool{true, true, false}},
+		{"big jump", []uint64{1, 2, 1 << 40, 2, 1<<40 - 1, 1 << 40}, []bool{true, true, true, false, true, false}},
+		{"jump of a window", []uint64{3, replayWindowWords * 64, 3 + replayWindowWords*64}, []bool{true, true, true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &replayWindow{}
+			for i, seq := range tc.seqs {
+				if got := w.accept(seq); got != tc.want[i] {
+					t.Fatalf("sequence number %d (#%d) accepted %v, want %v", seq, i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestReplayWindowStale checks the bits of the words the window slides over are cleared, so
+// a sequence number a whole ring ahead of one seen is not taken for it.
+func TestReplayWindowStale(t *testing.T) {
+	w := &replayWindow{}
+	for seq := uint64(0); seq < replayWindowWords*64; seq++ {
+		if !w.accept(seq) {
+			t.Fatalf("sequence number %d dropped", seq)
+		}
+	}
+	for seq := uint64(replayWindowWords * 64); seq < 3*replayWindowWords*64; seq += 7 {
+		if !w.accept(seq) {
+			t.Fatalf("sequence number %d dropped after the window slid", seq)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package pinlib
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionTokenSize is the size of the token a session is resumed with.
+const sessionTokenSize = 16
+
+// DefaultResumeWindow is how long a session whose connection was lost is kept for the client to resume it.
+var DefaultResumeWindow = 2 * time.Minute
+
+// ErrUnknownSession is returned when a client resumes a session the server doesn't hold (anymore).
+var ErrUnknownSession = errors.New("unknown session")
+
+// newSessionToken is used to generate a random session token.
+func newSessionToken() ([sessionTokenSize]byte, error) {
+	var token [sessionTokenSize]byte
+	_, err := rand.Read(token[:])
+	return token, err
+}
+
+// resumableConn is the connection a session exchanges packets over. The connection underneath
+// can be replaced when the client resumes the session, so the lease, the Exchanger and the
+// packets being sent outlive a lost connection.
+//
+// When the connection fails, Read and Write wait for it to be replaced and retry, or fail once
+// the session is given up. The client is told through onLost, and reconnects. The server waits
+// for the client to resume the session for the resume window.
+type resumableConn struct {
+	mu      sync.Mutex
+	conn    *CryptoConn
+	lost    bool          // conn failed and is waiting to be replaced
+	dead    bool          // the session expired or is closed
+	resumed chan struct{} // closed once a lost conn is replaced or the session expires
+	closed  chan struct{}
+	once    sync.Once
+	window  time.Duration
+
+	// packets dropped over the connections replaced, see ReplayStat
+	replayed, dropped uint64
+
+	// onLost is run when the connection fails, to replace it. nil on the server.
+	onLost func()
+}
+
+// newResumableConn is used to create a new resumableConn over conn for the server, which gives up
+// on the session if the client doesn't resume it within window.
+func newResumableConn(conn *CryptoConn, window time.Duration) *resumableConn {
+	if window <= 0 {
+		window = DefaultResumeWindow
+	}
+	return &resumableConn{conn: conn, resumed: make(chan struct{}), closed: make(chan struct{}), window: window}
+}
+
+// newClientResumableConn is used to create a new resumableConn over conn for the client. onLost
+// is run whenever the connection fails, and either replaces it with resume or calls giveUp.
+func newClientResumableConn(conn *CryptoConn, onLost func()) *resumableConn {
+	return &resumableConn{conn: conn, resumed: make(chan struct{}), closed: make(chan struct{}), onLost: onLost}
+}
+
+// current method returns the connection the session currently runs over.
+func (c *resumableConn) current() *CryptoConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// ReplayStat holds the number of packets of a session dropped by the replay protection, and over
+// datagram transports for failing to authenticate, over every connection the session ran over.
+type ReplayStat struct {
+	Replayed uint64 // packets dropped by the replay protection
+	Dropped  uint64 // datagrams dropped for failing to authenticate
+}
+
+// replayStat method returns the packets dropped over the session so far.
+func (c *resumableConn) replayStat() ReplayStat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ReplayStat{
+		Replayed: c.replayed + atomic.LoadUint64(&c.conn.Replayed),
+		Dropped:  c.dropped + atomic.LoadUint64(&c.conn.Dropped),
+	}
+}
+
+// Read method implements io.Reader interface for the resumableConn
+func (c *resumableConn) Read(p []byte) (int, error) {
+	for {
+		conn := c.current()
+		n, err := conn.Read(p)
+		if err == nil {
+			return n, nil
+		}
+		if !c.wait(conn, true) {
+			return n, err
+		}
+	}
+}
+
+// Write method implements io.Writer interface for the resumableConn.
+// On the client, a packet failing to be written is written again once the session is resumed.
+// The server drops the packets of a client that lost its connection instead, as waiting for
+// the client would stall the packets of every other client.
+func (c *resumableConn) Write(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		conn, dropping := c.conn, c.lost && !c.dead && c.onLost == nil
+		c.mu.Unlock()
+		if dropping {
+			return len(p), nil
+		}
+
+		n, err := conn.Write(p)
+		if err == nil {
+			return n, nil
+		}
+		if !c.wait(conn, c.onLost != nil) {
+			return n, err
+		}
+	}
+}
+
+// Close method implements io.Closer interface for the resumableConn. The session can't be resumed anymore.
+func (c *resumableConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dead = true
+	return c.conn.Close()
+}
+
+// wait method marks the failed connection as lost and, if block is set, waits for it to be
+// replaced. It reports whether the session is still alive, false if it expired or was closed.
+func (c *resumableConn) wait(failed *CryptoConn, block bool) bool {
+	c.mu.Lock()
+	if c.dead {
+		c.mu.Unlock()
+		return false
+	}
+	if c.conn != failed {
+		// already replaced, the failure is of the old connection being closed
+		c.mu.Unlock()
+		return true
+	}
+
+	resumed := c.resumed
+	if !c.lost {
+		c.lost = true
+		failed.Close()
+		if c.onLost != nil {
+			go c.onLost()
+		} else {
+			time.AfterFunc(c.window, func() { c.expire(resumed) })
+		}
+	}
+	c.mu.Unlock()
+
+	if !block {
+		return true
+	}
+
+	select {
+	case <-resumed:
+	case <-c.closed:
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.dead
+}
+
+// expire method gives up on the session if the connection lost is still not replaced.
+func (c *resumableConn) expire(resumed chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed == resumed && c.lost {
+		c.dead = true
+		close(c.resumed)
+	}
+}
+
+// giveUp method gives up on the session, the connection lost won't be replaced.
+func (c *resumableConn) giveUp() {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	c.expire(resumed)
+}
+
+// resume method replaces the connection of the session. The previous connection is closed,
+// as it may not have been noticed to be lost yet. It reports whether the session could be
+// resumed, false if it expired or was closed.
+func (c *resumableConn) resume(conn *CryptoConn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dead {
+		return false
+	}
+
+	c.conn.Close()
+	c.replayed += atomic.LoadUint64(&c.conn.Replayed)
+	c.dropped += atomic.LoadUint64(&c.conn.Dropped)
+	c.conn = conn
+	if c.lost {
+		c.lost = false
+		close(c.resumed)
+		c.resumed = make(chan struct{})
+	}
+	return true
+}
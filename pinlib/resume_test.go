@@ -0,0 +1,34 @@
+package pinlib
+
+import (
+	"net"
+	"testing"
+)
+
+// newPipeCryptoConn returns a CryptoConn over one end of a pipe.
+func newPipeCryptoConn(t *testing.T) *CryptoConn {
+	c, _ := net.Pipe()
+	conn, err := NewCryptoConn(NewRecordConn(c), SessionKeys{}, DefaultRekeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestReplayStatAcrossResumes(t *testing.T) {
+	first := newPipeCryptoConn(t)
+	first.Replayed, first.Dropped = 3, 1
+	session := newResumableConn(first, 0)
+	defer session.Close()
+
+	second := newPipeCryptoConn(t)
+	second.Replayed, second.Dropped = 2, 5
+	if !session.resume(second) {
+		t.Fatal("resume failed")
+	}
+
+	got := session.replayStat()
+	if got != (ReplayStat{Replayed: 5, Dropped: 6}) {
+		t.Fatalf("got %+v, want the counts of both connections", got)
+	}
+}
@@ -0,0 +1,152 @@
+package pinlib
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+// ClientRouting is the policy for the packets a client sends to another client.
+type ClientRouting int
+
+// All the available ClientRouting policies
+const (
+	// ClientRoutingKernel leaves the packets to the kernel of the server, they are written to
+	// the tunneling interface like every other packet. Forwarding has to be set up on the host.
+	ClientRoutingKernel ClientRouting = iota
+	ClientRoutingAllow                // the packets are handed to the other client right away
+	ClientRoutingDeny                 // the packets are dropped
+	ClientRoutingGroup                // the packets are handed over if both users are of the same group, dropped otherwise
+)
+
+// String method implements the stringer interface
+func (r ClientRouting) String() string {
+	switch r {
+	case ClientRoutingKernel:
+		return "kernel"
+	case ClientRoutingAllow:
+		return "allow"
+	case ClientRoutingDeny:
+		return "deny"
+	case ClientRoutingGroup:
+		return "group"
+	}
+	return "unknown"
+}
+
+// route is where the packets to the addresses of a client are written to.
+type route struct {
+	w    io.WriteCloser // queue of the packets to the client
+	user string         // authenticated user of the client
+	ips  []string       // addresses leased to the client, the IPv4 one first
+}
+
+// subnetRoute is a subnet behind a client, routed to the client.
+type subnetRoute struct {
+	subnet *net.IPNet
+	prefix int // prefix length of the subnet
+	r      *route
+}
+
+// routeTable maps the addresses leased to the clients, and the subnets behind them, to their
+// routes. The packets to an address are routed by the longest prefix matching it, the leased
+// addresses being full length prefixes. It is read by every Mux goroutine for every packet,
+// and written as the clients come and go, so it is safe for concurrent use.
+type routeTable struct {
+	mu      sync.RWMutex
+	routes  map[string]*route
+	subnets []subnetRoute // longest prefix first. Searched in turn, subnets are few
+}
+
+// newRouteTable is used to create an empty routeTable
+func newRouteTable() *routeTable {
+	return &routeTable{routes: make(map[string]*route)}
+}
+
+// add method routes the packets to the addresses of a client, and to the subnets behind it, to w.
+// A subnet already routed to another client is taken over, as the client advertising it is
+// bound to be the same one coming back.
+func (t *routeTable) add(ips []string, subnets []*net.IPNet, w io.WriteCloser, user string) {
+	r := &route{w: w, user: user, ips: ips}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ip := range ips {
+		t.routes[ip] = r
+	}
+
+	for _, subnet := range subnets {
+		prefix, _ := subnet.Mask.Size()
+		t.subnets = t.without(func(s subnetRoute) bool { return s.subnet.String() == subnet.String() })
+		t.subnets = append(t.subnets, subnetRoute{subnet: subnet, prefix: prefix, r: r})
+	}
+	sort.SliceStable(t.subnets, func(i, j int) bool { return t.subnets[i].prefix > t.subnets[j].prefix })
+}
+
+// without method returns the subnet routes other than the ones matching drop.
+func (t *routeTable) without(drop func(s subnetRoute) bool) []subnetRoute {
+	kept := t.subnets[:0]
+	for _, s := range t.subnets {
+		if !drop(s) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// remove method removes the routes of a client and closes w, so that a Mux goroutine
+// writing to it doesn't block. Addresses routed elsewhere in the meantime are left alone.
+func (t *routeTable) remove(ips []string, w io.WriteCloser) {
+	t.mu.Lock()
+	for _, ip := range ips {
+		if r, ok := t.routes[ip]; ok && r.w == w {
+			delete(t.routes, ip)
+		}
+	}
+	t.subnets = t.without(func(s subnetRoute) bool { return s.r.w == w })
+	t.mu.Unlock()
+
+	w.Close()
+}
+
+// lookup method returns the route of the client an address is leased to, or else of the client
+// with the longest subnet containing it.
+func (t *routeTable) lookup(ip []byte) (*route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if r, ok := t.routes[string(ip)]; ok {
+		return r, true
+	}
+	for _, s := range t.subnets {
+		if s.subnet.Contains(net.IP(ip)) {
+			return s.r, true
+		}
+	}
+	return nil, false
+}
+
+// identities method returns the authenticated user for every leased IPv4 address.
+func (t *routeTable) identities() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ids := make(map[string]string)
+	for ip, r := range t.routes {
+		if ip == r.ips[0] {
+			ids[net.IP(ip).String()] = r.user
+		}
+	}
+	return ids
+}
+
+// closeAll method closes the routes of every client.
+func (t *routeTable) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ip, r := range t.routes {
+		r.w.Close()
+		delete(t.routes, ip)
+	}
+	t.subnets = nil
+}
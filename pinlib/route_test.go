@@ -0,0 +1,166 @@
+package pinlib
+
+import (
+	"net"
+	"testing"
+)
+
+// routeWriter is the queue of a route, remembering whether it was closed.
+type routeWriter struct {
+	name   string
+	closed bool
+}
+
+func (w *routeWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *routeWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+// routeKey returns the key an address is routed by, as leased to a client.
+func routeKey(ip string) string {
+	addr := net.ParseIP(ip)
+	if ip4 := addr.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(addr)
+}
+
+// subnets parses a list of subnets and fails the test on error.
+func subnets(t *testing.T, cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// expectRoute fails the test when an address isn't routed to the writer named, "" for none.
+func expectRoute(t *testing.T, table *routeTable, ip, want string) {
+	got := ""
+	if r, ok := table.lookup([]byte(routeKey(ip))); ok {
+		got = r.w.(*routeWriter).name
+	}
+	if got != want {
+		t.Fatalf("%s routed to %q, want %q", ip, got, want)
+	}
+}
+
+func TestRouteTableLookup(t *testing.T) {
+	table := newRouteTable()
+	alice, bob, carol := &routeWriter{name: "alice"}, &routeWriter{name: "bob"}, &routeWriter{name: "carol"}
+	table.add([]string{routeKey("10.0.0.2"), routeKey("fd00::2")}, subnets(t, "192.168.0.0/16", "fd01::/48"), alice, "alice")
+	table.add([]string{routeKey("10.0.0.3")}, subnets(t, "192.168.1.0/24", "fd01:0:0:1::/64"), bob, "bob")
+	table.add([]string{routeKey("10.0.0.4")}, subnets(t, "10.0.0.0/8"), carol, "carol")
+
+	for _, tc := range []struct {
+		ip, want string
+	}{
+		{"10.0.0.2", "alice"},
+		{"fd00::2", "alice"},
+		{"192.168.1.5", "bob"}, // the longest prefix wins
+		{"192.168.2.5", "alice"},
+		{"fd01:0:0:1::5", "bob"},
+		{"fd01:0:0:2::5", "alice"},
+		{"10.0.0.3", "bob"}, // leased addresses win over the subnets containing them
+		{"10.0.0.9", "carol"},
+		{"172.16.0.1", ""},
+		{"fd02::1", ""},
+	} {
+		expectRoute(t, table, tc.ip, tc.want)
+	}
+
+	ids := table.identities()
+	if len(ids) != 3 || ids["10.0.0.2"] != "alice" || ids["10.0.0.3"] != "bob" {
+		t.Fatalf("got identities %v", ids)
+	}
+}
+
+// TestRouteTableTakeover checks a subnet advertised again is routed to the client advertising
+// it last, and stays routed to it when the client it was taken over from goes away.
+func TestRouteTableTakeover(t *testing.T) {
+	table := newRouteTable()
+	first, second := &routeWriter{name: "first"}, &routeWriter{name: "second"}
+	table.add([]string{routeKey("10.0.0.2")}, subnets(t, "192.168.1.0/24", "192.168.2.0/24"), first, "alice")
+	expectRoute(t, table, "192.168.1.5", "first")
+
+	// the same client back over a new connection, with the same address
+	table.add([]string{routeKey("10.0.0.2")}, subnets(t, "192.168.1.0/24"), second, "alice")
+	expectRoute(t, table, "10.0.0.2", "second")
+	expectRoute(t, table, "192.168.1.5", "second")
+	expectRoute(t, table, "192.168.2.5", "first")
+	if len(table.subnets) != 2 {
+		t.Fatalf("%d subnet routes, want the one taken over replaced", len(table.subnets))
+	}
+
+	table.remove([]string{routeKey("10.0.0.2")}, first)
+	if !first.closed {
+		t.Fatal("the queue of the client gone wasn't closed")
+	}
+	expectRoute(t, table, "10.0.0.2", "second")
+	expectRoute(t, table, "192.168.1.5", "second")
+	expectRoute(t, table, "192.168.2.5", "")
+
+	table.remove([]string{routeKey("10.0.0.2")}, second)
+	expectRoute(t, table, "10.0.0.2", "")
+	expectRoute(t, table, "192.168.1.5", "")
+	if len(table.routes) != 0 || len(table.subnets) != 0 {
+		t.Fatalf("%d routes and %d subnet routes left", len(table.routes), len(table.subnets))
+	}
+}
+
+func TestAuthorizeSubnets(t *testing.T) {
+	s := &Server{Subnets: map[string][]*net.IPNet{
+		"alice": subnets(t, "10.1.0.0/16", "fd00:1::/48"),
+		"bob":   subnets(t, "10.2.0.0/24"),
+	}}
+
+	for _, tc := range []struct {
+		user       string
+		advertised []string
+		want       []string
+	}{
+		{"alice", []string{"10.1.2.0/24", "10.1.0.0/16", "fd00:1:0:1::/64"}, []string{"10.1.2.0/24", "10.1.0.0/16", "fd00:1:0:1::/64"}},
+		{"alice", []string{"10.0.0.0/8", "10.2.0.0/24", "fd00::/16"}, nil}, // wider than allowed, or elsewhere
+		{"alice", []string{"10.1.255.0/24", "10.2.0.0/16"}, []string{"10.1.255.0/24"}},
+		{"bob", []string{"10.2.0.128/25", "10.1.2.0/24"}, []string{"10.2.0.128/25"}},
+		{"carol", []string{"10.1.2.0/24"}, nil},
+		{"", []string{"10.1.2.0/24"}, nil}, // clients sharing the secret advertise nothing
+	} {
+		got := s.authorizeSubnets(tc.user, subnets(t, tc.advertised...))
+		if len(got) != len(tc.want) {
+			t.Fatalf("%q advertising %v: got %v, want %v", tc.user, tc.advertised, got, tc.want)
+		}
+		for i := range got {
+			if got[i].String() != tc.want[i] {
+				t.Fatalf("%q advertising %v: got %v, want %v", tc.user, tc.advertised, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	networks := subnets(t, "10.0.0.0/8", "fd00::/8")
+	for _, tc := range []struct {
+		subnet string
+		want   bool
+	}{
+		{"10.0.0.0/8", true},
+		{"10.20.0.0/16", true},
+		{"10.20.30.40/32", true},
+		{"0.0.0.0/0", false},
+		{"11.0.0.0/8", false},
+		{"fd12::/16", true},
+		{"fe00::/8", false},
+		{"::ffff:10.0.0.0/104", false}, // an IPv6 prefix is never within an IPv4 network
+	} {
+		if got := within(subnets(t, tc.subnet)[0], networks); got != tc.want {
+			t.Fatalf("%s within %v: got %v, want %v", tc.subnet, networks, got, tc.want)
+		}
+	}
+}
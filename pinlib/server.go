@@ -1,75 +1,270 @@
 package pinlib
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Server struct contains all fields for exchanging packets to the client through a TCP connection
+var (
+	// DefaultHandshakeTimeout is the HandshakeTimeout of a new Server and Client
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// DefaultMaxPendingHandshakes is the MaxPendingHandshakes of a new Server
+	DefaultMaxPendingHandshakes = 64
+
+	errTooManyHandshakes = errors.New("too many handshakes pending")
+
+	// handshakeFailureLogInterval is how often at most a failed handshake is logged
+	handshakeFailureLogInterval = 10 * time.Second
+)
+
+// Server struct contains all fields for exchanging packets to the client through a TCP or UDP connection
 type Server struct {
-	gw      *net.IPNet
-	server  net.Listener
-	iface   io.ReadWriter
-	running bool
-	secret  [32]byte
-	close   chan bool
+	gw        *net.IPNet
+	server    net.Listener
+	transport string
+	iface     io.ReadWriter
+	secret    [32]byte
+	close     chan bool // closed by Close
+	closeOnce sync.Once
+	mux       *ifaceMux
+	sessions  map[[sessionTokenSize]byte]*serverSession // sessions by their token, to be resumed
+	smu       sync.Mutex
+
+	// Exported
+	Rekey RekeyPolicy         // Rekey specifies when the session keys are rotated
+	Users map[string][32]byte // Users holds the secret of every user, if set the shared secret is not accepted
+
+	// PublicKeys holds the user of every authorized client static key. Clients authenticating with
+	// a static key use the shared secret as the pre shared key. If set, the shared secret alone
+	// is not accepted.
+	PublicKeys map[[32]byte]string
+
+	Push PushConfig // Push holds the DNS servers, routes and MTU pushed to the clients
+
+	// ClientRouting is the policy for the packets a client sends to the address of another client.
+	// Unless ClientRoutingKernel, they never reach the tunneling interface, so clients reach each
+	// other without forwarding set up on the server host.
+	ClientRouting ClientRouting
+	Groups        map[string]string // Groups holds the group of the users, for ClientRoutingGroup
+
+	// ACLs holds the packet filter of every user, and GroupACLs of every group, for the users
+	// without one of their own. The packets of the users with neither are not filtered.
+	ACLs      map[string]*ACL
+	GroupACLs map[string]*ACL
+
+	// RateLimit limits the bandwidth of every client, and RateLimits of every user, for the users
+	// without a limit of their own. The packets to a client are delayed in a queue of its own,
+	// the ones which don't fit are dropped, so a MaxDelay doesn't hold up the other clients.
+	RateLimit  RateLimit
+	RateLimits map[string]RateLimit
+
+	// Subnets holds the networks the subnets advertised by every user have to be within. The
+	// packets to an accepted subnet are routed to the client advertising it, for site to site
+	// tunnels. Clients sharing the secret can't advertise any.
+	Subnets map[string][]*net.IPNet
+
+	// Leases leases the addresses of the tunnel network to the clients. Addresses can be
+	// excluded from it or reserved for a user before the server is started.
+	Leases *LeasePool
+
+	// IPv6 holds the IPv6 network of the tunnel along with the address of the server in it.
+	// If set, every client is leased an IPv6 address too. nil for an IPv4 only tunnel.
+	IPv6 *net.IPNet
+
+	// ResumeWindow is how long the lease of a client which lost its connection is held for
+	// it to resume the session. If 0, DefaultResumeWindow is used.
+	ResumeWindow time.Duration
+
+	// Keepalive specifies how a dead client is noticed. Its session is ended right away,
+	// freeing the lease, without waiting for it to be resumed.
+	Keepalive Keepalive
+
+	HandshakeTimeout     time.Duration // HandshakeTimeout is how long a client has to go through with the handshake
+	MaxPendingHandshakes int           // MaxPendingHandshakes is the number of handshakes run at once, clients beyond are refused
+
+	handshakeFailures uint64      // number of handshakes failed, timed out or refused, updated atomically
+	failureLogged     int64       // unix nano timestamp of the last failed handshake logged, updated atomically
+	shaping           ShapingStat // bytes delayed or dropped by the rate limits, updated atomically
+	queueDrops        uint64      // bytes to the clients dropped for not fitting in their queue, updated atomically
 }
 
-// NewServer method is used to create a new server struct with a given listening address
-func NewServer(addr string, iface io.ReadWriter, gw *net.IPNet, secret [32]byte) (*Server, error) {
-	ln, err := net.Listen("tcp", addr)
+// serverSession is a session a client can resume with its token.
+type serverSession struct {
+	user string
+	ip   net.IP // IPv4 address leased to the session
+	conn *resumableConn
+}
+
+// NewServer method is used to create a new server struct with a given listening address.
+// transport is either TransportTCP or TransportUDP.
+func NewServer(transport, addr string, iface io.ReadWriter, gw *net.IPNet, secret [32]byte) (*Server, error) {
+	leases, err := NewLeasePool(gw)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := listen(transport, addr)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Server{server: ln, iface: iface, gw: gw, running: false, secret: secret, close: make(chan bool)}, nil
+	return &Server{Leases: leases, server: ln, transport: transport, iface: iface, gw: gw, secret: secret, close: make(chan bool), mux: &ifaceMux{routes: newRouteTable(), iface: iface}, sessions: make(map[[sessionTokenSize]byte]*serverSession), Rekey: DefaultRekeyPolicy, Keepalive: DefaultKeepalive, HandshakeTimeout: DefaultHandshakeTimeout, MaxPendingHandshakes: DefaultMaxPendingHandshakes}, nil
 }
 
+// NotifierConn is the connection of a client, which cleans up after the client once the exchange ends.
 type NotifierConn struct {
 	io.ReadWriteCloser
-	ip   string
-	comm chan string
+	done func() // removes the routes of the client and frees its lease
 	wg   *sync.WaitGroup
+	once sync.Once
 }
 
+// Notify method is called by either direction of the Exchanger as it stops, the clean up is done once.
 func (conn *NotifierConn) Notify() {
-	conn.ReadWriteCloser.Close()
-	conn.comm <- conn.ip
-	conn.wg.Done()
+	conn.once.Do(func() {
+		conn.ReadWriteCloser.Close()
+		conn.done()
+		conn.wg.Done()
+	})
 }
 
-func (s *Server) nextIP(lastIP net.IP) (net.IP, bool) {
-	for i := len(lastIP) - 1; i >= 0; i-- {
-		lastIP[i]++
-		if lastIP[i] != 0 {
-			break
-		}
+// lookupSecret method returns the secret a user authenticates with.
+// The shared secret is used by clients without a user name, as long as no users or public keys are configured.
+func (s *Server) lookupSecret(user string) ([32]byte, bool) {
+	if user == "" {
+		return s.secret, len(s.Users) == 0 && len(s.PublicKeys) == 0
+	}
+	secret, ok := s.Users[user]
+	return secret, ok
+}
+
+// lookupPublicKey method returns the user of an authorized client static key.
+func (s *Server) lookupPublicKey(pub [32]byte) (string, [32]byte, bool) {
+	user, ok := s.PublicKeys[pub]
+	return user, s.secret, ok
+}
+
+// Identities method returns the authenticated user for every leased address.
+// Clients authenticated with the shared secret have an empty user name.
+func (s *Server) Identities() map[string]string {
+	return s.mux.routes.identities()
+}
+
+// GetReplayStats method returns the packets dropped over every session, keyed by the leased
+// IPv4 address. The packets are counted over every connection of a session, across resumes.
+func (s *Server) GetReplayStats() map[string]ReplayStat {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	stats := make(map[string]ReplayStat, len(s.sessions))
+	for _, session := range s.sessions {
+		stats[session.ip.String()] = session.conn.replayStat()
 	}
-	if !s.gw.Contains(lastIP) {
+	return stats
+}
+
+// pairedIPv6 method returns the IPv6 address leased along with an IPv4 address.
+// It is as far from the IPv6 address of the server as the IPv4 address is from the
+// IPv4 address of the server, so the pairs never collide.
+func (s *Server) pairedIPv6(ip net.IP) (net.IP, bool) {
+	ip4, gw4 := ip.To4(), s.gw.IP.To4()
+	offset := int64(binary.BigEndian.Uint32(ip4)) - int64(binary.BigEndian.Uint32(gw4))
+
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, s.IPv6.IP.To16())
+	base := binary.BigEndian.Uint64(ip6[8:])
+	low := base + uint64(offset)
+	high := binary.BigEndian.Uint64(ip6[:8])
+	if offset > 0 && low < base {
+		high++
+	} else if offset < 0 && low > base {
+		high--
+	}
+	binary.BigEndian.PutUint64(ip6[8:], low)
+	binary.BigEndian.PutUint64(ip6[:8], high)
+
+	if !s.IPv6.Contains(ip6) {
 		return nil, false
 	}
-	return lastIP.To4(), true
+	return ip6, true
+}
+
+// authorizeSubnets method returns the subnets advertised by a user which are within the networks
+// the user is allowed. The others are refused, and logged.
+func (s *Server) authorizeSubnets(user string, advertised []*net.IPNet) []*net.IPNet {
+	var accepted []*net.IPNet
+	for _, subnet := range advertised {
+		if user != "" && within(subnet, s.Subnets[user]) {
+			accepted = append(accepted, subnet)
+		} else {
+			fmt.Printf("Refused subnet %s advertised by user %q\n", subnet, user)
+		}
+	}
+	return accepted
 }
 
-func foundInMap(k string, dict map[string]io.WriteCloser) bool {
-	for key := range dict {
-		if key == k {
+// within reports whether a subnet is within any of the networks.
+func within(subnet *net.IPNet, networks []*net.IPNet) bool {
+	prefix, bits := subnet.Mask.Size()
+	for _, n := range networks {
+		nprefix, nbits := n.Mask.Size()
+		if bits == nbits && prefix >= nprefix && n.Contains(subnet.IP) {
 			return true
 		}
 	}
 	return false
 }
 
-// Start method accepts TCP connections from a client and starts the packet exchange from the local tunneling interface to the remote client
+// resumeSession method resumes the session of the token sent in a msgResume over a new connection.
+// The session has to belong to the user the new connection is authenticated as.
+func (s *Server) resumeSession(conn *CryptoConn, req *message, user string) error {
+	var token [sessionTokenSize]byte
+	p, _ := req.get(optSessionToken)
+	copy(token[:], p)
+
+	s.smu.Lock()
+	session, ok := s.sessions[token]
+	s.smu.Unlock()
+	if len(p) != sessionTokenSize || !ok || session.user != user {
+		writeMessage(conn, newErrorMessage(ErrUnknownSession.Error()))
+		return ErrUnknownSession
+	}
+
+	// the reply has to go out before any packet of the session does
+	err := writeMessage(conn, newMessage(msgResumeReply))
+	if err != nil {
+		return err
+	}
+
+	if !session.conn.resume(conn) {
+		return ErrUnknownSession
+	}
+	return nil
+}
+
+// forgetSession method forgets a session that ended, it can't be resumed anymore.
+func (s *Server) forgetSession(token [sessionTokenSize]byte) {
+	s.smu.Lock()
+	delete(s.sessions, token)
+	s.smu.Unlock()
+}
+
+// Start method accepts connections from a client and starts the packet exchange from the local tunneling interface to the remote client
 // This also makes Server struct to satisfy the pinlib.Peer interface.
 func (s *Server) Start() error {
 	wg := &sync.WaitGroup{}
 
-	mux := &ifaceMux{conn: make(map[string]io.WriteCloser, 0), iface: s.iface, sig: make(chan string)}
-
-	s.running = true
+	mux := s.mux
+	mux.policy, mux.groups = s.ClientRouting, s.Groups
+	mux.acls, mux.groupACLs = s.ACLs, s.GroupACLs
 
 	// TODO : profile the runtime for multiplexing
 	go mux.Mux()
@@ -78,159 +273,374 @@ func (s *Server) Start() error {
 	go mux.Mux()
 	go mux.Mux()
 	go mux.Mux()
-	go mux.cleanup()
 
-	lastIP := make(net.IP, 4)
-	copy(lastIP, s.gw.IP.To4())
+	fmt.Println(s.gw)
 
-	fmt.Println(lastIP)
+	// every accepted connection is handshaked in a goroutine of its own, so a client that
+	// doesn't go through with the handshake can't hold up the others.
+	pending := make(chan struct{}, s.MaxPendingHandshakes)
 	go func() {
-		for s.running {
+		for {
 			cx, err := s.server.Accept()
 			if err != nil {
+				select {
+				case <-s.close:
+					// the listener was closed
+					return
+				default:
+				}
 				fmt.Println(err)
 				continue
 			}
 
-			conn := NewCryptoConn(cx, s.secret)
-
-			hreq := make([]byte, 5)
-			_, err = conn.Read(hreq)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-
-			if string(hreq) != "IPPLS" {
-				fmt.Println("Discarding connection due to wrong handshake request from: ", conn.RemoteAddr(), string(hreq))
+			select {
+			case pending <- struct{}{}:
+			default:
+				// too many handshakes pending already
+				s.handshakeFailed(cx, errTooManyHandshakes)
 				continue
 			}
 
-			var available bool
-
-			lastIP, available = s.nextIP(lastIP)
-			if !available {
-				xx := make(net.IP, 4)
-				copy(xx, s.gw.IP.To4())
-				var found bool
-				var avail bool = false
-				for {
-					xx, found = s.nextIP(xx)
-					if !found {
-						break
-					}
-					if !foundInMap(string(xx), mux.conn) {
-						lastIP = xx.To4()
-						avail = true
-						break
-					}
-				}
-				if !avail {
-					conn.Write([]byte{0})
-					continue
+			go func() {
+				err := s.handshake(cx, wg)
+				<-pending
+				if err != nil {
+					s.handshakeFailed(cx, err)
 				}
-			}
+			}()
+		}
+	}()
 
-			prefix, _ := s.gw.Mask.Size()
-			hsd := append([]byte(lastIP), byte(prefix))
-			hsd = append(hsd, []byte(s.gw.IP.To4())...)
-			_, err = conn.Write(hsd)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
+	<-s.close
+	fmt.Println("Closing existing connections...")
+	//mux.Close()
+	fmt.Println("Closed all the muxes")
+	return nil
+}
 
-			p := make([]byte, 1)
+// handshakeFailed method counts a failed handshake and closes the connection. Why it failed is
+// logged at most once every handshakeFailureLogInterval, so a flood of clients doesn't flood the log.
+func (s *Server) handshakeFailed(cx net.Conn, err error) {
+	failures := atomic.AddUint64(&s.handshakeFailures, 1)
 
-			_, err = conn.Read(p)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.failureLogged)
+	if now-last >= int64(handshakeFailureLogInterval) && atomic.CompareAndSwapInt64(&s.failureLogged, last, now) {
+		fmt.Printf("Handshake with %s failed: %s (%d failed so far)\n", cx.RemoteAddr(), handshakeFailure(err), failures)
+	}
+	cx.Close()
+}
 
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
+// handshakeFailure returns why a handshake failed, the class of the failure if it is a known one.
+func handshakeFailure(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timed out"
+	}
+	switch {
+	case errors.Is(err, ErrUnsupportedVersion):
+		return "version mismatch"
+	case errors.Is(err, ErrUnknownUser):
+		return "unknown user"
+	case errors.Is(err, ErrUnknownPublicKey):
+		return "unknown public key"
+	case errors.Is(err, ErrPoolExhausted):
+		return "no address left to lease"
+	case errors.Is(err, ErrUnknownSession):
+		return "unknown session"
+	}
+	return err.Error()
+}
 
-			if p[0] != 1 {
-				lastIP[3]--
-				fmt.Println("client wasn't happy")
-				continue
-			}
+// handshake method runs the handshake of an accepted connection, which has to be done within
+// HandshakeTimeout. The client either resumes its session over the connection, or is leased
+// an address for a new session and the packet exchange with it is started.
+func (s *Server) handshake(cx net.Conn, wg *sync.WaitGroup) error {
+	cx.SetDeadline(time.Now().Add(s.HandshakeTimeout))
 
-			fmt.Println("Negotiated addr : ", lastIP)
+	rc := newTransportRecordConn(s.transport, cx)
 
-			pr, pw := io.Pipe()
+	keys, user, err := serverKeyExchange(rc, s)
+	if err != nil {
+		return err
+	}
+
+	conn, err := NewCryptoConn(rc, keys, s.Rekey)
+	if err != nil {
+		return err
+	}
 
-			mux.conn[string(lastIP)] = pw
+	req, err := readMessage(conn, msgLeaseRequest, msgResume)
+	if err != nil {
+		return err
+	}
 
-			ex := &Exchanger{conn: &NotifierConn{ReadWriteCloser: conn, ip: string(lastIP), comm: mux.sig, wg: wg}, iface: &ifaceClient{pr: pr, wr: s.iface, addr: p}}
-			wg.Add(1)
-			go ex.Start()
+	if req.typ == msgResume {
+		cx.SetDeadline(time.Time{})
+		endHandshake(cx)
+		err = s.resumeSession(conn, req, user)
+		if err != nil {
+			return err
 		}
-	}()
+		fmt.Printf("Resumed session from %s (user %q)\n", cx.RemoteAddr(), user)
+		return nil
+	}
 
-	<-s.close
-	fmt.Println("Closing existing connections...")
-	//mux.Close()
-	fmt.Println("Closed all the muxes")
+	var requested net.IP
+	if r, ok := req.get(optRequestedIPv4); ok && len(r) == net.IPv4len {
+		requested = net.IP(r)
+	}
+
+	ip, err := s.Leases.Allocate(user, requested)
+	if err != nil {
+		writeMessage(conn, newErrorMessage(err.Error()))
+		return err
+	}
+
+	prefix, _ := s.gw.Mask.Size()
+	reply := newMessage(msgLeaseReply)
+	reply.set(optIPv4, append([]byte(ip.To4()), byte(prefix)))
+	reply.set(optGateway, []byte(s.gw.IP.To4()))
+
+	var ip6 net.IP
+	if s.IPv6 != nil {
+		var available bool
+		ip6, available = s.pairedIPv6(ip)
+		if !available {
+			s.Leases.Release(ip)
+			writeMessage(conn, newErrorMessage("no IPv6 address available for lease"))
+			return errors.New("no IPv6 address available for lease")
+		}
+		prefix6, _ := s.IPv6.Mask.Size()
+		reply.set(optIPv6, append([]byte(ip6), byte(prefix6)))
+		reply.set(optGateway6, []byte(s.IPv6.IP.To16()))
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		s.Leases.Release(ip)
+		return err
+	}
+	reply.set(optSessionToken, token[:])
+
+	var subnets []*net.IPNet
+	if p, ok := req.get(optSubnets); ok {
+		advertised, err := decodeNets(p)
+		if err != nil {
+			s.Leases.Release(ip)
+			return err
+		}
+		subnets = s.authorizeSubnets(user, advertised)
+		if len(subnets) > 0 {
+			reply.set(optSubnets, encodeNets(subnets))
+		}
+	}
+
+	s.Push.set(reply)
+	err = writeMessage(conn, reply)
+	if err != nil {
+		s.Leases.Release(ip)
+		return err
+	}
+
+	_, err = readMessage(conn, msgLeaseAck)
+	if err != nil {
+		// client wasn't happy
+		s.Leases.Release(ip)
+		return err
+	}
+	cx.SetDeadline(time.Time{})
+	endHandshake(cx)
+
+	fmt.Printf("Negotiated addr : %s %s (user %q)\n", ip, ip6, user)
+
+	queue := newPacketQueue(clientQueueSize, &s.queueDrops)
+
+	ips := []string{string(ip)}
+	if ip6 != nil {
+		ips = append(ips, string(ip6))
+	}
+	s.mux.routes.add(ips, subnets, queue, user)
+
+	rconn := newResumableConn(conn, s.ResumeWindow)
+	go rconn.keepalive(s.Keepalive)
+	s.smu.Lock()
+	s.sessions[token] = &serverSession{user: user, ip: ip, conn: rconn}
+	s.smu.Unlock()
+
+	done := func() {
+		fmt.Printf("Removed client : %s (user %q)\n", ip, user)
+		s.mux.routes.remove(ips, queue)
+		s.Leases.Release(ip)
+	}
+
+	limit, ok := s.RateLimits[user]
+	if !ok {
+		limit = s.RateLimit
+	}
+
+	ex := &Exchanger{conn: &NotifierConn{ReadWriteCloser: rconn, done: done, wg: wg}, iface: &ifaceClient{queue: queue, wr: s.iface, mux: s.mux, user: user, addr: append([]byte{}, ip...)}}
+	ex.ingress = newTokenBucket(limit.In, limit.Burst, limit.MaxDelay, &s.shaping.DelayedIn, &s.shaping.DroppedIn)
+	ex.egress = newTokenBucket(limit.Out, limit.Burst, limit.MaxDelay, &s.shaping.DelayedOut, &s.shaping.DroppedOut)
+	wg.Add(1)
+	go func() {
+		ex.Start()
+		s.forgetSession(token)
+	}()
 	return nil
 }
 
+// Close method stops accepting connections and makes Start return.
 func (s *Server) Close() {
-	s.running = false
-	s.close <- true
+	s.closeOnce.Do(func() {
+		close(s.close)
+		s.server.Close()
+	})
 }
 
 type ifaceClient struct {
-	addr []byte
-	pr   io.Reader // pipe reader end
-	wr   io.Writer // iface fd itself
+	addr  []byte
+	queue io.Reader // queue of the packets to the client
+	wr    io.Writer // iface fd itself
+	mux   *ifaceMux // routes the packets to the other clients
+	user  string    // authenticated user of the client
 }
 
 // To client
 func (i *ifaceClient) Read(p []byte) (int, error) {
-	return i.pr.Read(p)
+	return i.queue.Read(p)
 }
 
 // From client
 func (i *ifaceClient) Write(p []byte) (int, error) {
+	// the packets from the client carry the tunnel header for openbsd by now
+	pkt := p
+	if runtime.GOOS == "openbsd" && len(p) >= 4 {
+		pkt = p[4:]
+	}
+
+	if acl := i.mux.acl(i.user); acl != nil && !acl.allows(pkt, false) {
+		atomic.AddUint64(&i.mux.filteredIn, 1)
+		return len(p), nil
+	}
+
+	if i.mux.policy != ClientRoutingKernel {
+		if dst, ok := packetDestination(pkt); ok {
+			if r, ok := i.mux.routes.lookup(dst); ok {
+				i.mux.forward(pkt, i.user, r)
+				return len(p), nil
+			}
+		}
+	}
 	return i.wr.Write(p)
 }
 
+// FilterStat holds the number of packets dropped by the ACLs of the clients.
+type FilterStat struct {
+	In  uint64 // packets from the clients
+	Out uint64 // packets to the clients
+}
+
+// GetHandshakeFailures method returns the number of handshakes failed, timed out or refused so far.
+func (s *Server) GetHandshakeFailures() uint64 {
+	return atomic.LoadUint64(&s.handshakeFailures)
+}
+
+// GetQueueDrops method returns the number of bytes to the clients dropped so far for not fitting
+// in their queue, the clients being slower than the packets routed to them.
+func (s *Server) GetQueueDrops() uint64 {
+	return atomic.LoadUint64(&s.queueDrops)
+}
+
+// GetFilterStat method returns the number of packets dropped by the ACLs so far.
+func (s *Server) GetFilterStat() FilterStat {
+	return FilterStat{In: atomic.LoadUint64(&s.mux.filteredIn), Out: atomic.LoadUint64(&s.mux.filteredOut)}
+}
+
+// GetShapingStat method returns the number of bytes delayed or dropped by the rate limits so far.
+func (s *Server) GetShapingStat() ShapingStat {
+	return ShapingStat{
+		DelayedIn:  atomic.LoadUint64(&s.shaping.DelayedIn),
+		DroppedIn:  atomic.LoadUint64(&s.shaping.DroppedIn),
+		DelayedOut: atomic.LoadUint64(&s.shaping.DelayedOut),
+		DroppedOut: atomic.LoadUint64(&s.shaping.DroppedOut),
+	}
+}
+
 type ifaceMux struct {
-	conn  map[string]io.WriteCloser // pipe's writing end
-	iface io.Reader
-	sig   chan string
+	filteredIn  uint64 // packets from the clients dropped by their ACL
+	filteredOut uint64 // packets to the clients dropped by their ACL
+
+	routes    *routeTable
+	iface     io.Reader
+	policy    ClientRouting     // policy for the packets between the clients
+	groups    map[string]string // group of the users
+	acls      map[string]*ACL   // packet filter of the users
+	groupACLs map[string]*ACL   // packet filter of the groups
+}
+
+// acl method returns the packet filter of a user, nil if its packets are not filtered.
+func (m *ifaceMux) acl(user string) *ACL {
+	if acl, ok := m.acls[user]; ok {
+		return acl
+	}
+	if group, ok := m.groups[user]; ok {
+		return m.groupACLs[group]
+	}
+	return nil
+}
+
+// send method writes a packet to the client of the route, unless its ACL drops it.
+func (m *ifaceMux) send(p []byte, r *route) {
+	if acl := m.acl(r.user); acl != nil && !acl.allows(p, true) {
+		atomic.AddUint64(&m.filteredOut, 1)
+		return
+	}
+
+	_, err := r.w.Write(p)
+	if err != nil && err != io.ErrClosedPipe {
+		fmt.Println(err)
+	}
+}
+
+// forward method hands a packet from a client of the given user to the client of the route,
+// if the policy lets it through. The packet is dropped otherwise.
+func (m *ifaceMux) forward(p []byte, user string, r *route) {
+	switch m.policy {
+	case ClientRoutingDeny:
+		return
+	case ClientRoutingGroup:
+		group, ok := m.groups[user]
+		if !ok || group != m.groups[r.user] {
+			return
+		}
+	}
+
+	m.send(p, r)
 }
 
-// Sendback muxing
+// Sendback muxing. Returns once reading the tunneling interface fails.
 func (m *ifaceMux) Mux() {
 	p := make([]byte, MTU)
 	for {
-		n, _ := m.iface.Read(p)
-		dst := p[16:20]
-		cl, ok := m.conn[string(dst)]
+		n, err := m.iface.Read(p)
+		if err != nil {
+			// the tunneling interface is gone, nothing more to read from it
+			fmt.Println("Mux : ", err)
+			return
+		}
+		dst, ok := packetDestination(p[:n])
 		if !ok {
 			continue
 		}
-
-		_, err := cl.Write(p[:n])
-		if err != nil {
-			fmt.Println(err)
+		r, ok := m.routes.lookup(dst)
+		if !ok {
+			continue
 		}
-	}
-}
 
-func (m *ifaceMux) cleanup() {
-	for {
-		clientIp := <-m.sig
-		fmt.Println("Removed client : ", []byte(clientIp))
-		delete(m.conn, clientIp)
+		m.send(p[:n], r)
 	}
 }
 
 func (i *ifaceMux) Close() {
-	for _, val := range i.conn {
-		val.Close()
-	}
-
-	close(i.sig)
+	i.routes.closeAll()
 }
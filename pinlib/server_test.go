@@ -0,0 +1,264 @@
+package pinlib
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idleIface is a tunneling interface with no traffic, every packet written to it is discarded.
+// Reading it blocks for ever.
+type idleIface struct{}
+
+func (i *idleIface) Read(p []byte) (int, error) {
+	select {}
+}
+
+func (i *idleIface) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// trafficIface is a tunneling interface sending packets to every address of 10.20.0.0/24 in
+// turn at a steady pace, till closed. Every packet written to it is discarded.
+type trafficIface struct {
+	closed chan struct{}
+	next   uint32
+}
+
+func (i *trafficIface) Read(p []byte) (int, error) {
+	select {
+	case <-i.closed:
+		return 0, io.EOF
+	default:
+	}
+
+	time.Sleep(100 * time.Microsecond)
+	n := atomic.AddUint32(&i.next, 1)
+	packet := ipv4Packet(net.IPv4(10, 20, 0, 1), net.IPv4(10, 20, 0, byte(2+n%253)))
+	return copy(p, packet), nil
+}
+
+func (i *trafficIface) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// ipv4Packet returns an empty IPv4 packet.
+func ipv4Packet(src, dst net.IP) []byte {
+	p := make([]byte, 20)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], 20)
+	copy(p[12:16], src.To4())
+	copy(p[16:20], dst.To4())
+	return p
+}
+
+// activeLeases returns the number of addresses leased to connected clients.
+func activeLeases(p *LeasePool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, l := range p.leases {
+		if l.active {
+			n++
+		}
+	}
+	return n
+}
+
+// TestServerChurn connects and disconnects many clients at once while the mux routes packets
+// to them, checks every session is torn down once its client is gone, then closes the server
+// while clients are still connecting. Run it with -race.
+func TestServerChurn(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, transport := range []string{TransportTCP, TransportUDP} {
+		t.Run(transport, func(t *testing.T) {
+			var secret [32]byte
+			secret[0] = 1
+			ip, gw, _ := net.ParseCIDR("10.20.0.1/24")
+			gw.IP = ip
+
+			iface := &trafficIface{closed: make(chan struct{})}
+			defer close(iface.closed)
+			srv, err := NewServer(transport, "127.0.0.1:0", iface, gw, secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the sessions of the clients gone end right away
+			srv.ResumeWindow = 10 * time.Millisecond
+			srv.Keepalive = Keepalive{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond}
+			addr := srv.server.Addr().String()
+
+			started := make(chan error, 1)
+			go func() { started <- srv.Start() }()
+
+			var joined, received uint64
+			churn := func(clients, rounds int) *sync.WaitGroup {
+				wg := &sync.WaitGroup{}
+				for i := 0; i < clients; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for r := 0; r < rounds; r++ {
+							c := NewClient(addr, iface, secret)
+							c.Transport = transport
+							c.HandshakeTimeout = 200 * time.Millisecond
+							conn, err := c.connect(addr)
+							if err != nil {
+								continue
+							}
+							if _, _, err := c.handshake(conn); err != nil {
+								conn.Close()
+								continue
+							}
+
+							atomic.AddUint64(&joined, 1)
+
+							// take the packets routed to it for a while
+							go func() {
+								p := make([]byte, MTU)
+								for {
+									if _, err := conn.Read(p); err != nil {
+										return
+									}
+									atomic.AddUint64(&received, 1)
+								}
+							}()
+							time.Sleep(time.Duration(5+r*3) * time.Millisecond)
+							conn.Close()
+						}
+					}()
+				}
+				return wg
+			}
+
+			churn(32, 8).Wait()
+			if joined < 32*8/2 {
+				t.Fatalf("only %d clients of %d joined", joined, 32*8)
+			}
+			if received == 0 {
+				t.Fatal("no packet was routed to the clients")
+			}
+			t.Logf("%d clients joined, %d packets routed to them", joined, received)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				srv.mux.routes.mu.RLock()
+				routes := len(srv.mux.routes.routes)
+				srv.mux.routes.mu.RUnlock()
+				srv.smu.Lock()
+				sessions := len(srv.sessions)
+				srv.smu.Unlock()
+				leases := activeLeases(srv.Leases)
+
+				if routes == 0 && sessions == 0 && leases == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%d routes, %d sessions and %d leases left once the clients are gone", routes, sessions, leases)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// close the server while clients are still at it
+			wg := churn(16, 4)
+			time.Sleep(20 * time.Millisecond)
+			srv.Close()
+			wg.Wait()
+
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Start didn't return once the server was closed")
+			}
+		})
+	}
+}
+
+func TestServerHandshakeFailures(t *testing.T) {
+	var secret [32]byte
+	ip, gw, _ := net.ParseCIDR("10.20.0.1/24")
+	gw.IP = ip
+
+	iface := &idleIface{}
+	srv, err := NewServer(TransportTCP, "127.0.0.1:0", iface, gw, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Users = map[string][32]byte{"alice": secret}
+	go srv.Start()
+	defer srv.Close()
+	addr := srv.server.Addr().String()
+
+	c := NewClient(addr, iface, secret)
+	c.User = "mallory"
+	if _, err := c.connect(addr); err == nil {
+		t.Fatal("an unknown user got through the key exchange")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.GetHandshakeFailures() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d handshakes failed, want 1", srv.GetHandshakeFailures())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestHandshakeFailureClass runs the server side of the key exchange against bad hellos and
+// checks the failures are classed.
+func TestHandshakeFailureClass(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		hello func() *message
+		class string
+	}{
+		{"version", func() *message {
+			m := newMessage(msgHello)
+			m.version = ProtocolVersion + 1
+			return m
+		}, "version mismatch"},
+		{"user", func() *message {
+			_, pub, _ := GenerateKey()
+			m := newMessage(msgHello)
+			m.set(optUser, []byte("mallory"))
+			m.set(optEphemeralKey, pub[:])
+			return m
+		}, "unknown user"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				_, _, err := serverKeyExchange(NewRecordConn(s), sharedSecret{})
+				s.Close()
+				done <- err
+			}()
+
+			rc := NewRecordConn(c)
+			if err := writeMessage(rc, tc.hello()); err != nil {
+				t.Fatal(err)
+			}
+			readMessage(rc, msgHelloReply)
+
+			err := <-done
+			if err == nil {
+				t.Fatal("the key exchange went through")
+			}
+			if got := handshakeFailure(err); got != tc.class {
+				t.Fatalf("%s classed as %q, want %q", err, got, tc.class)
+			}
+		})
+	}
+}
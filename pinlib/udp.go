@@ -0,0 +1,629 @@
+package pinlib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transports a tunnel can be carried over
+const (
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+)
+
+const (
+	// sessionIDSize is the size of the session ID every UDP datagram starts with.
+	sessionIDSize = 8
+
+	// udpBacklog is the number of new sessions waiting to be accepted, and the number
+	// of datagrams waiting to be read by a session. Datagrams beyond that are dropped.
+	udpBacklog = 64
+
+	// udpOverhead is the number of bytes a packet grows by in a datagram: the IP header (of
+	// IPv6, the larger one), the UDP header, the session ID, the record header and the sealing.
+	udpOverhead = 40 + 8 + sessionIDSize + recordHeaderSize + sealOverhead
+
+	// udpRetransmitTimeout is how long a reply is waited for during the handshake before the
+	// datagram is sent again. It doubles with every retransmission, up to udpMaxRetransmitTimeout.
+	udpRetransmitTimeout    = 500 * time.Millisecond
+	udpMaxRetransmitTimeout = 4 * time.Second
+)
+
+// TunnelMTU returns the MTU of a tunnel over transport, for its packets to go through a path
+// of pathMTU without being fragmented. Over UDP every packet goes in a datagram of its own,
+// which has to fit the path. Over TCP the packets are carried in a stream, the path MTU is
+// no limit to them.
+func TunnelMTU(transport string, pathMTU int) int {
+	if transport == TransportUDP {
+		return pathMTU - udpOverhead
+	}
+	return pathMTU
+}
+
+var (
+	errClosed  = errors.New("use of closed connection")
+	errTimeout = timeoutError{}
+)
+
+// timeoutError is returned by the UDP connections when a read deadline is hit.
+// It satisfies net.Error, just like the timeouts of the net package.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// datagramConn is implemented by the connections which carry one record per datagram.
+// Such connections are lossy, so records failing to authenticate are dropped instead
+// of tearing down the connection.
+type datagramConn interface {
+	datagram()
+}
+
+// roamingConn is implemented by the connections which follow the peer to the address
+// its last authenticated record came from.
+type roamingConn interface {
+	authenticated()
+}
+
+// handshaker is implemented by the connections which have to be told when the handshake is
+// over, as they retransmit the handshake messages.
+type handshaker interface {
+	handshakeDone()
+}
+
+// endHandshake tells the connection under a CryptoConn or a RecordConn that the handshake is
+// over, if it has to be told.
+func endHandshake(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case handshaker:
+			c.handshakeDone()
+			return
+		case *CryptoConn:
+			conn = c.Conn
+		case *RecordConn:
+			conn = c.Conn
+		default:
+			return
+		}
+	}
+}
+
+// udpRetransmitter makes the handshake over UDP go through lost datagrams. As every handshake
+// message is a reply to the one before it, the first datagram written after a datagram is read
+// is kept as the reply to it. If no datagram comes back in time, the reply is sent again. If the
+// datagram replied to is read again, the peer missed the reply, so it is sent again instead of
+// the datagram being read twice. Once the handshake is done, nothing is sent again on a timeout,
+// but the peer is replied to till it sends something new, it may have missed the last reply.
+type udpRetransmitter struct {
+	rmu   sync.Mutex
+	state int
+	last  []byte // last datagram read
+	reply []byte // first datagram written after it, nil till written
+	rto   time.Duration
+}
+
+// states of a udpRetransmitter
+const (
+	udpHandshaking = iota
+	udpHandshakeDone
+	udpEstablished
+)
+
+// handshakeDone method implements handshaker interface for the udpRetransmitter.
+func (r *udpRetransmitter) handshakeDone() {
+	r.rmu.Lock()
+	if r.state == udpHandshaking {
+		r.state = udpHandshakeDone
+	}
+	r.rmu.Unlock()
+}
+
+// wrote method is called with every datagram written.
+func (r *udpRetransmitter) wrote(datagram []byte) {
+	r.rmu.Lock()
+	if r.state != udpEstablished && r.reply == nil {
+		r.reply = append([]byte{}, datagram...)
+		r.rto = udpRetransmitTimeout
+	}
+	r.rmu.Unlock()
+}
+
+// received method is called with every datagram read. If it was read before, the reply to it
+// is returned, to be sent again, and the datagram is dropped.
+func (r *udpRetransmitter) received(datagram []byte) ([]byte, bool) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	if r.state == udpEstablished {
+		return nil, false
+	}
+	if r.last != nil && bytes.Equal(datagram, r.last) {
+		return r.reply, true
+	}
+	if r.state == udpHandshakeDone {
+		// the peer is done with the handshake too
+		r.state, r.last, r.reply = udpEstablished, nil, nil
+		return nil, false
+	}
+	r.last, r.reply = append([]byte{}, datagram...), nil
+	return nil, false
+}
+
+// pending method returns the reply to send again if no datagram is read within the returned
+// timeout, nil if there is none.
+func (r *udpRetransmitter) pending() ([]byte, time.Duration) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	if r.state != udpHandshaking || r.reply == nil {
+		return nil, 0
+	}
+	return r.reply, r.rto
+}
+
+// retransmitted method is called once the pending reply is sent again.
+func (r *udpRetransmitter) retransmitted() {
+	r.rmu.Lock()
+	r.rto *= 2
+	if r.rto > udpMaxRetransmitTimeout {
+		r.rto = udpMaxRetransmitTimeout
+	}
+	r.rmu.Unlock()
+}
+
+// newTransportRecordConn is used to create the record layer for a connection of the given transport.
+// Streams are compressed, datagrams are not, as a lost datagram would corrupt the compressed stream.
+func newTransportRecordConn(transport string, conn net.Conn) *RecordConn {
+	if transport == TransportUDP {
+		return NewRecordConn(conn)
+	}
+	return NewRecordConn(NewCompressorConn(conn))
+}
+
+// dial is used to connect to the remote pin over the given transport. A TCP endpoint not
+// accepting the connection within timeout is given up on.
+func dial(transport, remote string, timeout time.Duration) (net.Conn, error) {
+	switch transport {
+	case TransportTCP:
+		return net.DialTimeout("tcp", remote, timeout)
+	case TransportUDP:
+		return dialUDP(remote)
+	}
+	return nil, errors.New("unknown transport: " + transport)
+}
+
+// listen is used to listen for clients over the given transport.
+func listen(transport, addr string) (net.Listener, error) {
+	switch transport {
+	case TransportTCP:
+		return net.Listen("tcp", addr)
+	case TransportUDP:
+		return listenUDP(addr)
+	}
+	return nil, errors.New("unknown transport: " + transport)
+}
+
+// validRecordDatagram reports whether a datagram payload holds exactly one record.
+func validRecordDatagram(p []byte) bool {
+	return len(p) >= recordHeaderSize && int(binary.BigEndian.Uint16(p)) == len(p)-recordHeaderSize
+}
+
+// udpListener demultiplexes the datagrams received on a UDP socket into sessions by the
+// session ID they start with, so a session is not tied to the address of the client.
+// It satisfies net.Listener, so the server treats UDP sessions just like TCP connections.
+type udpListener struct {
+	conn     net.PacketConn
+	mu       sync.Mutex
+	sessions map[uint64]*udpConn
+	accept   chan *udpConn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// listenUDP is used to create a new udpListener listening at addr
+func listenUDP(addr string) (*udpListener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &udpListener{
+		conn:     conn,
+		sessions: make(map[uint64]*udpConn),
+		accept:   make(chan *udpConn, udpBacklog),
+		closed:   make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// serve method reads the datagrams off the socket and hands them to their sessions.
+// A hello of an unknown session starts a new one, which is then accepted. Other datagrams of
+// unknown sessions, like the ones still in flight for a session closed, are dropped.
+func (l *udpListener) serve() {
+	p := make([]byte, sessionIDSize+recordHeaderSize+MaxRecordSize())
+	for {
+		n, addr, err := l.conn.ReadFrom(p)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		if n < sessionIDSize || !validRecordDatagram(p[sessionIDSize:n]) {
+			continue
+		}
+
+		id := binary.BigEndian.Uint64(p)
+
+		l.mu.Lock()
+		session, ok := l.sessions[id]
+		if !ok {
+			if m, _ := parseMessage(p[sessionIDSize+recordHeaderSize : n]); m == nil || m.typ != msgHello {
+				l.mu.Unlock()
+				continue
+			}
+
+			session = &udpConn{id: id, l: l, addr: addr, in: make(chan udpDatagram, udpBacklog), closed: make(chan struct{})}
+			select {
+			case l.accept <- session:
+				l.sessions[id] = session
+			default:
+				// too many sessions waiting to be accepted
+				l.mu.Unlock()
+				continue
+			}
+		}
+		l.mu.Unlock()
+
+		session.deliver(addr, append([]byte{}, p[sessionIDSize:n]...))
+	}
+}
+
+// Accept method implements net.Listener interface for the udpListener.
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case session := <-l.accept:
+		return session, nil
+	case <-l.closed:
+		return nil, errClosed
+	}
+}
+
+// Close method implements net.Listener interface for the udpListener.
+func (l *udpListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.conn.Close()
+}
+
+// Addr method implements net.Listener interface for the udpListener.
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// remove method forgets a closed session.
+func (l *udpListener) remove(id uint64) {
+	l.mu.Lock()
+	delete(l.sessions, id)
+	l.mu.Unlock()
+}
+
+// udpDeadline holds the read deadline of a UDP connection.
+type udpDeadline struct {
+	dmu      sync.Mutex
+	deadline time.Time
+}
+
+// timer method returns a channel that fires when the read deadline is hit, nil if there is none.
+func (d *udpDeadline) timer() (<-chan time.Time, *time.Timer) {
+	d.dmu.Lock()
+	defer d.dmu.Unlock()
+	if d.deadline.IsZero() {
+		return nil, nil
+	}
+	t := time.NewTimer(time.Until(d.deadline))
+	return t.C, t
+}
+
+// get method returns the read deadline, zero if there is none.
+func (d *udpDeadline) get() time.Time {
+	d.dmu.Lock()
+	defer d.dmu.Unlock()
+	return d.deadline
+}
+
+// SetReadDeadline method implements net.Conn interface.
+func (d *udpDeadline) SetReadDeadline(t time.Time) error {
+	d.dmu.Lock()
+	d.deadline = t
+	d.dmu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline method implements net.Conn interface. Writes never block on UDP.
+func (d *udpDeadline) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// SetDeadline method implements net.Conn interface.
+func (d *udpDeadline) SetDeadline(t time.Time) error {
+	return d.SetReadDeadline(t)
+}
+
+// udpDatagram is a datagram received for a session along with the address it came from.
+type udpDatagram struct {
+	addr net.Addr
+	p    []byte
+}
+
+// udpConn is a server side UDP session. Every Read returns one datagram of the session and every
+// Write is sent as one datagram to the address the session was last authenticated from.
+type udpConn struct {
+	udpDeadline
+	udpRetransmitter
+	id     uint64
+	l      *udpListener
+	mu     sync.Mutex
+	addr   net.Addr // address the datagrams are sent to
+	from   net.Addr // address the last datagram read came from
+	in     chan udpDatagram
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *udpConn) datagram() {}
+
+// deliver method queues a datagram received from addr for reading.
+func (c *udpConn) deliver(addr net.Addr, p []byte) {
+	select {
+	case c.in <- udpDatagram{addr: addr, p: p}:
+	default:
+	}
+}
+
+// authenticated method is called once the last datagram read is authenticated. The replies
+// of the session are then sent to the address it came from, which lets a client roam
+// between networks. Datagrams failing to authenticate can't redirect the session.
+func (c *udpConn) authenticated() {
+	c.mu.Lock()
+	c.addr = c.from
+	c.mu.Unlock()
+}
+
+// Read method implements io.Reader interface for the udpConn
+func (c *udpConn) Read(p []byte) (int, error) {
+	deadline, t := c.timer()
+	if t != nil {
+		defer t.Stop()
+	}
+
+	for {
+		var retransmit <-chan time.Time
+		var rt *time.Timer
+		reply, rto := c.pending()
+		if reply != nil {
+			rt = time.NewTimer(rto)
+			retransmit = rt.C
+		}
+
+		select {
+		case d := <-c.in:
+			if rt != nil {
+				rt.Stop()
+			}
+			if reply, dup := c.received(d.p); dup {
+				if reply != nil {
+					c.send(reply)
+				}
+				continue
+			}
+			c.mu.Lock()
+			c.from = d.addr
+			c.mu.Unlock()
+			if len(d.p) > len(p) {
+				return 0, errShortDatagramBuffer
+			}
+			return copy(p, d.p), nil
+		case <-retransmit:
+			c.retransmitted()
+			c.send(reply)
+		case <-c.closed:
+			return 0, errClosed
+		case <-deadline:
+			return 0, errTimeout
+		}
+	}
+}
+
+// Write method implements io.Writer interface for the udpConn
+func (c *udpConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+
+	out := make([]byte, sessionIDSize+len(p))
+	binary.BigEndian.PutUint64(out, c.id)
+	copy(out[sessionIDSize:], p)
+
+	c.wrote(out)
+	err := c.send(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// send method sends a datagram to the address the session was last authenticated from.
+func (c *udpConn) send(datagram []byte) error {
+	_, err := c.l.conn.WriteTo(datagram, c.RemoteAddr())
+	return err
+}
+
+// Close method implements net.Conn interface for the udpConn
+func (c *udpConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.l.remove(c.id)
+	})
+	return nil
+}
+
+// LocalAddr method implements net.Conn interface for the udpConn
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.l.conn.LocalAddr()
+}
+
+// RemoteAddr method implements net.Conn interface for the udpConn
+func (c *udpConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+var errShortDatagramBuffer = errors.New("buffer too small for datagram")
+
+// udpClientConn is the client side of a UDP session. It sends from an unconnected socket,
+// so the source address follows the route to the server when the client changes networks.
+type udpClientConn struct {
+	udpRetransmitter
+	id       uint64
+	conn     *net.UDPConn
+	remote   *net.UDPAddr
+	buf      []byte
+	deadline udpDeadline // read deadline set, the socket is woken up before it to retransmit
+}
+
+func (c *udpClientConn) datagram() {}
+
+// dialUDP is used to start a new UDP session with a random session ID to the remote pin.
+func dialUDP(remote string) (*udpClientConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [sessionIDSize]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &udpClientConn{
+		id:     binary.BigEndian.Uint64(id[:]),
+		conn:   conn,
+		remote: raddr,
+		buf:    make([]byte, sessionIDSize+recordHeaderSize+MaxRecordSize()),
+	}, nil
+}
+
+// Read method implements io.Reader interface for the udpClientConn.
+// Datagrams not from the server or of another session are ignored.
+func (c *udpClientConn) Read(p []byte) (int, error) {
+	for {
+		reply, rto := c.pending()
+		if reply != nil {
+			wake := time.Now().Add(rto)
+			if d := c.deadline.get(); !d.IsZero() && d.Before(wake) {
+				wake = d
+			}
+			c.conn.SetReadDeadline(wake)
+		}
+
+		n, addr, err := c.conn.ReadFromUDP(c.buf)
+		if reply != nil {
+			c.conn.SetReadDeadline(c.deadline.get())
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && reply != nil {
+				if d := c.deadline.get(); d.IsZero() || time.Now().Before(d) {
+					c.retransmitted()
+					c.conn.WriteToUDP(reply, c.remote)
+					continue
+				}
+			}
+			return 0, err
+		}
+
+		if !addr.IP.Equal(c.remote.IP) || addr.Port != c.remote.Port {
+			continue
+		}
+
+		if n < sessionIDSize || binary.BigEndian.Uint64(c.buf) != c.id || !validRecordDatagram(c.buf[sessionIDSize:n]) {
+			continue
+		}
+
+		if reply, dup := c.received(c.buf[sessionIDSize:n]); dup {
+			if reply != nil {
+				c.conn.WriteToUDP(reply, c.remote)
+			}
+			continue
+		}
+
+		if n-sessionIDSize > len(p) {
+			return 0, errShortDatagramBuffer
+		}
+		return copy(p, c.buf[sessionIDSize:n]), nil
+	}
+}
+
+// Write method implements io.Writer interface for the udpClientConn
+func (c *udpClientConn) Write(p []byte) (int, error) {
+	out := make([]byte, sessionIDSize+len(p))
+	binary.BigEndian.PutUint64(out, c.id)
+	copy(out[sessionIDSize:], p)
+
+	c.wrote(out)
+	_, err := c.conn.WriteToUDP(out, c.remote)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close method implements net.Conn interface for the udpClientConn
+func (c *udpClientConn) Close() error {
+	return c.conn.Close()
+}
+
+// SetDeadline method implements net.Conn interface for the udpClientConn
+func (c *udpClientConn) SetDeadline(t time.Time) error {
+	c.deadline.SetReadDeadline(t)
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline method implements net.Conn interface for the udpClientConn
+func (c *udpClientConn) SetReadDeadline(t time.Time) error {
+	c.deadline.SetReadDeadline(t)
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline method implements net.Conn interface for the udpClientConn
+func (c *udpClientConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// LocalAddr method implements net.Conn interface for the udpClientConn
+func (c *udpClientConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr method implements net.Conn interface for the udpClientConn
+func (c *udpClientConn) RemoteAddr() net.Addr {
+	return c.remote
+}
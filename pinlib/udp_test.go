@@ -0,0 +1,220 @@
+package pinlib
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyRelay relays the datagrams of a client to a server, dropping the ones it is told to.
+type lossyRelay struct {
+	conn   *net.UDPConn
+	server *net.UDPAddr
+
+	mu       sync.Mutex
+	client   *net.UDPAddr
+	up, down int                       // number of datagrams relayed to the server and to the client
+	drop     func(up bool, n int) bool // reports whether the nth datagram in a direction is dropped
+}
+
+func newLossyRelay(t *testing.T, server string, drop func(up bool, n int) bool) *lossyRelay {
+	saddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &lossyRelay{conn: conn, server: saddr, drop: drop}
+	go r.serve()
+	return r
+}
+
+func (r *lossyRelay) serve() {
+	p := make([]byte, 65536)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(p)
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		up := !addr.IP.Equal(r.server.IP) || addr.Port != r.server.Port
+		to := r.server
+		count := &r.up
+		if up {
+			r.client = addr
+		} else {
+			to, count = r.client, &r.down
+		}
+		dropped := r.drop(up, *count)
+		*count++
+		r.mu.Unlock()
+
+		if !dropped && to != nil {
+			r.conn.WriteToUDP(p[:n], to)
+		}
+	}
+}
+
+// TestUDPHandshakeLoss checks the handshake goes through whichever of its datagrams is lost,
+// and that the server ends up holding the session the client thinks it has.
+func TestUDPHandshakeLoss(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tc := range []struct {
+		name string
+		up   bool
+		n    int
+	}{
+		{"hello", true, 0},
+		{"hello reply", false, 0},
+		{"lease request", true, 1},
+		{"lease reply", false, 1},
+		{"lease ack", true, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var secret [32]byte
+			ip, gw, _ := net.ParseCIDR("10.30.0.1/24")
+			gw.IP = ip
+
+			iface := &idleIface{}
+			srv, err := NewServer(TransportUDP, "127.0.0.1:0", iface, gw, secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.Start()
+			defer srv.Close()
+
+			relay := newLossyRelay(t, srv.server.Addr().String(), func(up bool, n int) bool {
+				return up == tc.up && n == tc.n
+			})
+			defer relay.conn.Close()
+			addr := relay.conn.LocalAddr().String()
+
+			c := NewClient(addr, iface, secret)
+			c.Transport = TransportUDP
+			c.orderEndpoints()
+			conn, lease, _, err := c.requestLease(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// the client reads the session from now on, which answers a lease reply sent again
+			go func() {
+				p := make([]byte, MTU)
+				for {
+					if _, err := conn.Read(p); err != nil {
+						return
+					}
+				}
+			}()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				if _, ok := srv.GetReplayStats()[lease.Address.IP.String()]; ok {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("the server holds no session for %s", lease.Address.IP)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestTunnelMTU(t *testing.T) {
+	if mtu := TunnelMTU(TransportTCP, 1500); mtu != 1500 {
+		t.Fatalf("got %d over tcp, want the path MTU", mtu)
+	}
+
+	mtu := TunnelMTU(TransportUDP, 1500)
+	if mtu != 1417 {
+		t.Fatalf("got %d over udp, want 1417", mtu)
+	}
+
+	// seal a full packet, and see how large the datagram carrying it is
+	defer func(old int) { MTU = old }(MTU)
+	MTU = mtu
+
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	cc, err := dialUDP(sink.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	conn, err := NewCryptoConn(NewRecordConn(cc), SessionKeys{}, DefaultRekeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, mtu)); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p := make([]byte, 65536)
+	n, _, err := sink.ReadFrom(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in IPv6 and UDP headers
+	if size := 40 + 8 + n; size != 1500 {
+		t.Fatalf("a full packet takes %d bytes on the path, want 1500", size)
+	}
+}
+
+// TestUDPStrayDatagram checks a datagram of an unknown session which isn't a hello, like
+// one still in flight for a session closed, is dropped without starting a session.
+func TestUDPStrayDatagram(t *testing.T) {
+	var secret [32]byte
+	ip, gw, _ := net.ParseCIDR("10.30.0.1/24")
+	gw.IP = ip
+
+	srv, err := NewServer(TransportUDP, "127.0.0.1:0", &idleIface{}, gw, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	defer srv.Close()
+
+	cc, err := dialUDP(srv.server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	conn, err := NewCryptoConn(NewRecordConn(cc), SessionKeys{}, DefaultRekeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endHandshake(conn)
+	if _, err := conn.Write([]byte("stray")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server answers a new session with its hello reply, or an error
+	cc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := cc.Read(make([]byte, MTU)); err == nil {
+		t.Fatal("the server answered a stray datagram")
+	}
+
+	l := srv.server.(*udpListener)
+	l.mu.Lock()
+	sessions := len(l.sessions)
+	l.mu.Unlock()
+	if sessions != 0 || srv.GetHandshakeFailures() != 0 {
+		t.Fatalf("a stray datagram started %d sessions and failed %d handshakes", sessions, srv.GetHandshakeFailures())
+	}
+}
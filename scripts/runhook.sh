@@ -5,7 +5,14 @@ FILENAME="/server.pin"
 # Create the config file
 echo > $FILENAME
 echo "Mode : server" >> $FILENAME
-echo "Address : 0.0.0.0:9090" >> $FILENAME
+# Listen at all interfaces of both the address families unless told otherwise
+if [ "$ADDRESS" == "" ]; then
+    ADDRESS="[::]:9090"
+fi
+echo "Address : \"$ADDRESS\"" >> $FILENAME
+if [ "$TRANSPORT" != "" ]; then
+    echo "Transport : $TRANSPORT" >> $FILENAME
+fi
 echo "MTU : 1500" >> $FILENAME
 echo "Interface : pin0" >> $FILENAME
 echo "DHCP : 10.0.0.1/24" >> $FILENAME
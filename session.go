@@ -11,9 +11,13 @@ import (
 // server to dial or the address to listen at.
 type Session struct {
 	*Config
-	ResolvedRemoteIP net.IP      // Contains the resolved IPv4 address of remote Peer
-	RemotePort       int         // Contains the port of the server the client is connecting to
-	InterfaceAddress string      // to be setup during in the hook function
-	InterfaceGateway string      // to be setup during in the hook function
-	peer             pinlib.Peer // to be setup before the connection initialization
+	Endpoint          string      // Contains the endpoint of the server the client is connected to, as configured
+	ResolvedRemoteIP  net.IP      // Contains the resolved IPv4 or IPv6 address of remote Peer
+	RemoteFamily      string      // Contains the address family of ResolvedRemoteIP, "ipv4" or "ipv6"
+	RemotePort        int         // Contains the port of the server the client is connecting to
+	InterfaceAddress  string      // to be setup during in the hook function
+	InterfaceGateway  string      // to be setup during in the hook function
+	InterfaceAddress6 string      // to be setup during in the hook function, empty if the tunnel is IPv4 only
+	InterfaceGateway6 string      // to be setup during in the hook function, empty if the tunnel is IPv4 only
+	peer              pinlib.Peer // to be setup before the connection initialization
 }
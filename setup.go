@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -39,11 +41,50 @@ func (s *Session) SetupClient() {
 		return
 	}
 
-	client.Hook = func(ipp, gw string) error {
+	client.Hook = func(lease *pinlib.Lease) error {
+		// the hook runs again on failing over to another endpoint
+		s.Endpoint = lease.Endpoint
+		if ip, port, ok := addrIPPort(lease.RemoteAddr); ok {
+			s.ResolvedRemoteIP = ip
+			s.RemotePort = port
+			s.RemoteFamily = addressFamily(ip)
+		}
+
+		ipp := lease.Address.String()
+		gw := lease.Gateway.String()
+
+		// the address is asked for again on the next start
+		if s.LastLeaseFile != "" {
+			err := ioutil.WriteFile(s.LastLeaseFile, []byte(lease.Address.IP.String()+"\n"), 0644)
+			if err != nil {
+				fmt.Println("[WARN] Saving the lease: ", err)
+			}
+		}
 
 		s.InterfaceAddress = ipp
 		s.InterfaceGateway = gw
 
+		ipp6, gw6 := "", ""
+		if lease.Address6 != nil {
+			ipp6 = lease.Address6.String()
+			gw6 = lease.Gateway6.String()
+		}
+		s.InterfaceAddress6 = ipp6
+		s.InterfaceGateway6 = gw6
+
+		// settings pushed by the server take effect unless configured locally.
+		// The MTU can't be raised beyond the local one, the packet buffers are sized by it.
+		mtu := s.MTU
+		if lease.MTU > 0 && lease.MTU <= s.MTU {
+			mtu = lease.MTU
+		}
+
+		dns := s.DNS
+		pushedDNS := ipStrings(lease.DNS)
+		if len(dns) == 0 {
+			dns = pushedDNS
+		}
+
 		scriptTmpl, ok := s.Config.PostConnectScript[runtime.GOOS]
 		if !ok {
 			fmt.Printf("[WARN] No post connect script defined for '%s' platform", runtime.GOOS)
@@ -52,12 +93,20 @@ func (s *Session) SetupClient() {
 
 		script, err := executeTemplate(scriptTmpl, map[string]interface{}{
 			"interfaceName": s.InterfaceName,
-			"mtu":           s.MTU,
+			"mtu":           mtu,
+			"endpoint":      s.Endpoint,
 			"remoteIP":      s.ResolvedRemoteIP.String(),
+			"remoteFamily":  s.RemoteFamily,
 			"remotePort":    s.RemotePort,
 			"tunIP":         ipp,
 			"tunGateway":    gw,
-			"dns":           s.DNS,
+			"tunIP6":        ipp6,
+			"tunGateway6":   gw6,
+			"dns":           dns,
+			"pushedDNS":     pushedDNS,
+			"pushedMTU":     lease.MTU,
+			"routes":        netStrings(lease.Routes),
+			"subnets":       netStrings(lease.Subnets),
 		})
 		if err != nil {
 			return err
@@ -74,11 +123,24 @@ func (s *Session) SetupServer() error {
 		return nil
 	}
 
+	// the subnets the clients may advertise, for the script to route through the tunneling interface
+	var subnets []string
+	userSubnets, err := s.Config.UserSubnets()
+	if err != nil {
+		return err
+	}
+	for _, nets := range userSubnets {
+		subnets = append(subnets, netStrings(nets)...)
+	}
+	sort.Strings(subnets)
+
 	script, err := executeTemplate(scriptTmpl, map[string]interface{}{
 		"interfaceName": s.InterfaceName,
 		"mtu":           s.MTU,
 		"tunIP":         s.DHCP,
+		"tunIP6":        s.DHCP6,
 		"dns":           s.DNS,
+		"subnets":       subnets,
 	})
 	if err != nil {
 		return err
@@ -96,10 +158,13 @@ func (s *Session) StopClient() error {
 
 	script, err := executeTemplate(scriptTmpl, map[string]interface{}{
 		"interfaceName": s.InterfaceName,
+		"endpoint":      s.Endpoint,
 		"remoteIP":      s.ResolvedRemoteIP.String(),
+		"remoteFamily":  s.RemoteFamily,
 		"remotePort":    s.RemotePort,
 		"mtu":           s.MTU,
 		"tunIP":         s.DHCP,
+		"tunIP6":        s.DHCP6,
 		"dns":           s.DNS,
 	})
 	if err != nil {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -35,3 +36,38 @@ func removeEmptiesAndStrip(strs []string) []string {
 	}
 	return x
 }
+
+func ipStrings(ips []net.IP) []string {
+	x := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		x = append(x, ip.String())
+	}
+	return x
+}
+
+func netStrings(nets []*net.IPNet) []string {
+	x := make([]string, 0, len(nets))
+	for _, n := range nets {
+		x = append(x, n.String())
+	}
+	return x
+}
+
+// addressFamily returns "ipv4" or "ipv6" as per the family of the address.
+func addressFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// addrIPPort returns the IP and the port of a TCP or UDP address.
+func addrIPPort(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, true
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return nil, 0, false
+}